@@ -0,0 +1,252 @@
+package amqp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/data-usage-api/db"
+	"github.com/cyverse-de/data-usage-api/natsconn"
+	"github.com/cyverse-de/data-usage-api/transport"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+)
+
+// deadLetterTTL is how long dead-lettered messages stay in the dead-letter
+// queues. The DE database keeps the record used for listing and replays.
+const deadLetterTTL = 14 * 24 * time.Hour
+
+// DeadLetterer moves update messages that failed for good to a dead-letter
+// exchange and records why they failed, so they can be replayed later.
+//
+// The messaging client doesn't support declaring queues with arguments, so
+// messages are dead-lettered by the handlers rather than by the broker. For
+// transports other than AMQP the record in the DE database is all there is.
+type DeadLetterer struct {
+	uri             string
+	exchange        string
+	batchQueue      string
+	individualQueue string
+	dedb            *sqlx.DB
+	configuration   *config.Config
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+// DeadLetterQueueName returns the name of the dead-letter queue for a queue.
+func DeadLetterQueueName(queue string) string {
+	return queue + ".dead-letter"
+}
+
+// NewDeadLetterer declares the dead-letter exchange along with a dead-letter
+// queue for each of the batch and individual queues.
+func NewDeadLetterer(uri, exchange, batchQueue, individualQueue string, dedb *sqlx.DB, configuration *config.Config) (*DeadLetterer, error) {
+	d := &DeadLetterer{
+		uri:             uri,
+		exchange:        exchange,
+		batchQueue:      batchQueue,
+		individualQueue: individualQueue,
+		dedb:            dedb,
+		configuration:   configuration,
+	}
+
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// NewRecordingDeadLetterer returns a DeadLetterer that only records dead
+// letters in the DE database, without publishing them anywhere.
+func NewRecordingDeadLetterer(batchQueue, individualQueue string, dedb *sqlx.DB, configuration *config.Config) *DeadLetterer {
+	return &DeadLetterer{
+		batchQueue:      batchQueue,
+		individualQueue: individualQueue,
+		dedb:            dedb,
+		configuration:   configuration,
+	}
+}
+
+// connect (re)establishes the channel and declares the dead-letter topology.
+// The caller should hold d.mu, except during construction.
+func (d *DeadLetterer) connect() error {
+	if d.conn != nil && !d.conn.IsClosed() {
+		_ = d.conn.Close()
+	}
+
+	conn, err := amqp.Dial(d.uri)
+	if err != nil {
+		return errors.Wrap(err, "Error connecting to the AMQP broker for dead-lettering")
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return errors.Wrap(err, "Error opening the dead-letter channel")
+	}
+
+	err = channel.ExchangeDeclare(d.exchange, "direct", true, false, false, false, nil)
+	if err != nil {
+		_ = conn.Close()
+		return errors.Wrap(err, "Error declaring the dead-letter exchange")
+	}
+
+	// Dead letters are routed by the name of the queue they failed on.
+	for _, queue := range []string{d.batchQueue, d.individualQueue} {
+		dlq := DeadLetterQueueName(queue)
+		_, err = channel.QueueDeclare(dlq, true, false, false, false, amqp.Table{
+			"x-message-ttl": int64(deadLetterTTL / time.Millisecond),
+		})
+		if err != nil {
+			_ = conn.Close()
+			return errors.Wrapf(err, "Error declaring dead-letter queue %s", dlq)
+		}
+
+		err = channel.QueueBind(dlq, queue, d.exchange, false, nil)
+		if err != nil {
+			_ = conn.Close()
+			return errors.Wrapf(err, "Error binding dead-letter queue %s", dlq)
+		}
+	}
+
+	d.conn = conn
+	d.channel = channel
+	return nil
+}
+
+// queueFor returns the queue a message with the key is consumed from.
+func (d *DeadLetterer) queueFor(key string) string {
+	if strings.HasPrefix(key, transport.SingleUserPrefix) {
+		return d.individualQueue
+	}
+	return d.batchQueue
+}
+
+// publish sends the message to the dead-letter exchange. It returns whether
+// the message was published, which it never is without an exchange.
+func (d *DeadLetterer) publish(queue string, del transport.Message, reason error) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.channel == nil {
+		return false, nil
+	}
+
+	msg := amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         del.Body(),
+		Headers: amqp.Table{
+			"x-original-routing-key": del.Key(),
+			"x-failure-reason":       reason.Error(),
+		},
+	}
+
+	err := d.channel.Publish(d.exchange, queue, false, false, msg)
+	if err == amqp.ErrClosed {
+		if err = d.connect(); err != nil {
+			return false, err
+		}
+		err = d.channel.Publish(d.exchange, queue, false, false, msg)
+	}
+	return err == nil, err
+}
+
+// deadLetterTimeout bounds recording a dead letter. The handler's own context
+// has often run out by the time a message is dead-lettered, so it isn't used.
+const deadLetterTimeout = 30 * time.Second
+
+// DeadLetter records the failed message in the DE database and publishes it to
+// the dead-letter exchange, if there is one. Either one is enough to keep a
+// trace of the message, so an error is only returned if neither succeeded.
+func (d *DeadLetterer) DeadLetter(ctx context.Context, del transport.Message, reason error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), deadLetterTimeout)
+	defer cancel()
+
+	ctx, span := otel.Tracer(otelName).Start(ctx, "DeadLetter")
+	defer span.End()
+
+	queue := d.queueFor(del.Key())
+
+	body := del.Body()
+	if body == nil {
+		body = []byte{}
+	}
+
+	id, recordErr := db.NewDE(d.dedb, d.configuration).AddDeadLetter(ctx, &db.DeadLetter{
+		Queue:      queue,
+		RoutingKey: del.Key(),
+		Body:       body,
+		Reason:     reason.Error(),
+	})
+	if recordErr != nil {
+		log.Error(errors.Wrap(recordErr, "Error recording dead letter"))
+	}
+
+	published, publishErr := d.publish(queue, del, reason)
+	if publishErr != nil {
+		log.Error(errors.Wrap(publishErr, "Error publishing dead letter"))
+	}
+
+	if recordErr != nil && !published {
+		return errors.Wrap(recordErr, "Error recording dead letter")
+	}
+
+	if recordErr != nil {
+		log.Infof("dead-lettered message %s from %s without recording it", del.Key(), queue)
+		return nil
+	}
+
+	log.Infof("dead-lettered message %s from %s as %s", del.Key(), queue, id)
+	return nil
+}
+
+// Close closes the dead-letter connection.
+func (d *DeadLetterer) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		_ = d.conn.Close()
+	}
+}
+
+// unavailableDelay is how long a message that failed because QMS is
+// unavailable waits before it's delivered again. It matches the default
+// circuit breaker cooldown.
+const unavailableDelay = 30 * time.Second
+
+// rejectFailed rejects a message that couldn't be processed. Messages that
+// failed because QMS is unavailable are delayed rather than counted as failed.
+// Otherwise the first failure is requeued; a redelivered message is
+// dead-lettered instead of dropped. If dead-lettering fails, the message is
+// requeued again so it isn't lost. It returns whether the message is gone for
+// good.
+func rejectFailed(ctx context.Context, del transport.Message, dl *DeadLetterer, reason error) bool {
+	if errors.Is(reason, natsconn.ErrQMSUnavailable) {
+		if err := del.Delay(unavailableDelay); err != nil {
+			log.Error(errors.Wrap(err, "Failed delaying failed message"))
+		}
+		return false
+	}
+
+	requeue := !del.Redelivered()
+	if !requeue && dl != nil {
+		if err := dl.DeadLetter(ctx, del, reason); err != nil {
+			log.Error(errors.Wrap(err, "Failed dead-lettering failed message, requeueing it"))
+			requeue = true
+		}
+	}
+
+	rejectErr := del.Reject(requeue)
+	if rejectErr != nil {
+		log.Error(errors.Wrap(rejectErr, "Failed rejecting failed message"))
+	}
+	return !requeue
+}
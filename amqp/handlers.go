@@ -2,6 +2,7 @@ package amqp
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"strings"
@@ -11,23 +12,20 @@ import (
 	"github.com/cyverse-de/data-usage-api/db"
 	"github.com/cyverse-de/data-usage-api/logging"
 	"github.com/cyverse-de/data-usage-api/natsconn"
+	"github.com/cyverse-de/data-usage-api/transport"
 	"github.com/cyverse-de/data-usage-api/util"
-	"github.com/cyverse-de/messaging/v9"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 	"go.opentelemetry.io/otel"
 )
 
 var otelName = "github.com/cyverse-de/data-usage-api/amqp"
 var log = logging.Log.WithFields(logrus.Fields{"package": "amqp"})
 
-const SingleUserPrefix = "index.usage.data.user"
-const BatchUserPrefix = "index.usage.data.batch.user"
-
-func UpdateUserHandler(ctx context.Context, del amqp.Delivery, dedb, icat *sqlx.DB, nc *natsconn.Connector, configuration *config.Config) error {
-	username := del.RoutingKey[len(SingleUserPrefix)+1:]
+func UpdateUserHandler(ctx context.Context, del transport.Message, dedb, icat *sqlx.DB, nc *natsconn.Connector, dl *DeadLetterer, configuration *config.Config) error {
+	username := del.Key()[len(transport.SingleUserPrefix)+1:]
 	user := util.FixUsername(username, configuration)
 
 	log.Tracef("Recalculating usage for %s asynchronously", user)
@@ -40,14 +38,11 @@ func UpdateUserHandler(ctx context.Context, del amqp.Delivery, dedb, icat *sqlx.
 
 	dbs := db.NewBoth(dedb, icat, configuration, nc)
 
-	res, err := dbs.UpdateUserDataUsage(ctx, user)
+	res, err := dbs.UpdateUserDataUsage(ctx, user, db.UsageSourceSingle)
 	if err != nil {
 		e := errors.Wrap(err, "Failed updating usage information")
 		log.Error(e)
-		rejectErr := del.Reject(!del.Redelivered)
-		if rejectErr != nil {
-			log.Error(errors.Wrap(rejectErr, "Failed rejecting failed message"))
-		}
+		rejectFailed(ctx, del, dl, e)
 		return e
 	}
 
@@ -59,10 +54,71 @@ func UpdateUserHandler(ctx context.Context, del amqp.Delivery, dedb, icat *sqlx.
 	return nil
 }
 
-func UpdateUserBatchHandler(ctx context.Context, del amqp.Delivery, dedb, icat *sqlx.DB, nc *natsconn.Connector, configuration *config.Config) error {
-	usernames := strings.SplitN(del.RoutingKey[len(BatchUserPrefix)+1:], ".", 2)
+// BatchMessage is the body of a batch update message. Incremental batches list
+// their users explicitly rather than covering everyone between the bounds.
+type BatchMessage struct {
+	JobID string   `json:"job_id,omitempty"`
+	Users []string `json:"users,omitempty"`
+}
+
+// ReplayBody returns the body to publish when replaying a dead-lettered
+// message. Batch messages lose their job ID, since the job they belonged to
+// already counted them as failed and may have finished since; a replayed batch
+// isn't part of any job.
+func ReplayBody(key string, body []byte) ([]byte, error) {
+	if !strings.HasPrefix(key, transport.BatchUserPrefix+".") || len(body) == 0 {
+		return body, nil
+	}
+
+	msg := &BatchMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, errors.Wrap(err, "Failed parsing batch message body")
+	}
+	if msg.JobID == "" {
+		return body, nil
+	}
+
+	msg.JobID = ""
+	return json.Marshal(msg)
+}
+
+// recordJobBatch reports the outcome of a batch back to the job it belongs to,
+// if any.
+func recordJobBatch(ctx context.Context, dedb *sqlx.DB, configuration *config.Config, msg *BatchMessage, succeeded bool, written, skipped int) {
+	if msg.JobID == "" {
+		return
+	}
+	err := db.NewDE(dedb, configuration).RecordUsageJobBatch(ctx, msg.JobID, succeeded, written, skipped)
+	if err != nil {
+		log.Error(errors.Wrap(err, fmt.Sprintf("Failed recording batch outcome for job %s", msg.JobID)))
+	}
+}
+
+// requeueUsers enqueues an individual update for each of the users.
+func requeueUsers(ctx context.Context, t transport.Transport, usernames []string) error {
+	var overallError error
+	for _, username := range usernames {
+		err := t.EnqueueUserUpdate(ctx, username)
+		if err != nil {
+			log.Error(errors.Wrap(err, fmt.Sprintf("Error requeueing update for %s", username)))
+			overallError = err
+		}
+	}
+	return overallError
+}
+
+func UpdateUserBatchHandler(ctx context.Context, del transport.Message, dedb, icat *sqlx.DB, nc *natsconn.Connector, t transport.Transport, dl *DeadLetterer, configuration *config.Config) error {
+	usernames := strings.SplitN(del.Key()[len(transport.BatchUserPrefix)+1:], ".", 2)
 	log.Infof("Updating the user batch from %s to %s", usernames[0], usernames[1])
 
+	// Messages published before jobs were tracked have an empty body.
+	msg := &BatchMessage{}
+	if body := del.Body(); len(body) > 0 {
+		if err := json.Unmarshal(body, msg); err != nil {
+			log.Error(errors.Wrap(err, "Failed parsing batch message body"))
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
 
@@ -71,28 +127,123 @@ func UpdateUserBatchHandler(ctx context.Context, del amqp.Delivery, dedb, icat *
 
 	dbs := db.NewBoth(dedb, icat, configuration, nc)
 
-	_, err := dbs.UpdateUserDataUsageBatch(ctx, usernames[0], usernames[1])
+	var err error
+	var results []natsconn.UserUpdateResult
+	if len(msg.Users) > 0 {
+		results, err = dbs.UpdateUsersDataUsage(ctx, msg.Users)
+	} else {
+		results, err = dbs.UpdateUserDataUsageBatch(ctx, usernames[0], usernames[1])
+	}
+
+	var failed []string
+	var written, skipped, unavailable int
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed = append(failed, r.Username)
+			if errors.Is(r.Err, natsconn.ErrQMSUnavailable) {
+				unavailable++
+			}
+		case r.Skipped:
+			skipped++
+		default:
+			written++
+		}
+	}
+
+	// If every failure was because QMS is unavailable, retry the whole batch
+	// rather than flooding the individual queue. Other failures are requeued
+	// individually below.
+	if err == nil && len(failed) > 0 && unavailable == len(failed) {
+		err = errors.Wrapf(natsconn.ErrQMSUnavailable, "all %d failed QMS updates in the batch", len(failed))
+	}
+
 	if err != nil {
 		e := errors.Wrap(err, "Failed updating usage information")
 		log.Error(e)
-		rejectErr := del.Reject(!del.Redelivered)
-		if rejectErr != nil {
-			log.Error(errors.Wrap(rejectErr, "Failed rejecting failed message"))
+		if rejectFailed(ctx, del, dl, e) {
+			recordJobBatch(ctx, dedb, configuration, msg, false, 0, 0)
 		}
 		return e
 	}
 
+	log.Infof("Batch from %s to %s: %d written to QMS, %d skipped as unchanged, %d failed", usernames[0], usernames[1], written, skipped, len(failed))
+
+	if len(failed) > 0 {
+		log.Infof("Requeueing %d of %d users from the batch from %s to %s individually", len(failed), len(results), usernames[0], usernames[1])
+		if err = requeueUsers(ctx, t, failed); err != nil {
+			log.Error(errors.Wrap(err, "Failed requeueing some users"))
+		}
+	}
+
+	recordJobBatch(ctx, dedb, configuration, msg, true, written, skipped)
+
 	return nil
 }
 
-func SendBatchMessages(ctx context.Context, del amqp.Delivery, dedb, icat *sqlx.DB, amqpClient *messaging.Client, configuration *config.Config) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Minute)
-	defer cancel()
+// incrementalOverlap is how far before the last successful job an incremental
+// job looks for changes. It covers changes made while that job was being set
+// up, along with clock differences between the ICAT and the DE database.
+const incrementalOverlap = 10 * time.Minute
 
-	ctx, span := otel.Tracer(otelName).Start(ctx, "SendBatchMessages")
+// changedUsersTimeout bounds the lookup of changed users, so that a catalog
+// missing the modify_ts indexes fails the incremental job with a clear error
+// rather than running into the scheduler's timeout.
+const changedUsersTimeout = 3 * time.Minute
+
+// jobBatch is a batch of users to be enqueued as part of a job.
+type jobBatch struct {
+	start string
+	end   string
+	users []string
+}
+
+// publishJob records a new job of the given kind, enqueues each of its
+// batches, and returns the ID of the job tracking their progress.
+func publishJob(ctx context.Context, d *db.DEDatabase, t transport.Transport, kind string, batches []jobBatch) (string, error) {
+	jobID, err := d.CreateUsageJob(ctx, kind, len(batches))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed creating job")
+	}
+
+	var overallError error
+	published := 0
+	for _, batch := range batches {
+		body, err := json.Marshal(&BatchMessage{JobID: jobID, Users: batch.users})
+		if err != nil {
+			log.Error(errors.Wrap(err, fmt.Sprintf("Error encoding message for batch %s - %s", batch.start, batch.end)))
+			overallError = err
+			continue
+		}
+
+		err = t.EnqueueBatch(ctx, batch.start, batch.end, body)
+		if err != nil {
+			log.Error(errors.Wrap(err, fmt.Sprintf("Error publishing message for batch %s - %s", batch.start, batch.end)))
+			overallError = err
+			// continue anyway though in case it's specific to this one batch
+			continue
+		}
+		published++
+	}
+
+	err = d.FinishPublishingUsageJob(ctx, jobID, published)
+	if err != nil {
+		log.Error(errors.Wrap(err, fmt.Sprintf("Failed recording published batches for job %s", jobID)))
+	}
+
+	log.Infof("Published %d of %d batches for %s job %s", published, len(batches), kind, jobID)
+
+	return jobID, overallError
+}
+
+// StartBatchJob splits all users into batches, enqueues each of them, and
+// returns the ID of the job tracking their progress.
+func StartBatchJob(ctx context.Context, dedb, icat *sqlx.DB, t transport.Transport, configuration *config.Config) (string, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "StartBatchJob")
 	defer span.End()
 
 	i := db.NewICAT(icat, configuration)
+	d := db.NewDE(dedb, configuration)
 
 	// Randomly add a number between -2 and 2
 	// i.e. in [0,5) minus 2
@@ -100,22 +251,234 @@ func SendBatchMessages(ctx context.Context, del amqp.Delivery, dedb, icat *sqlx.
 	// values that might otherwise repeatedly fall between batch bounds
 	boundModifier := rand.Intn(5) - 2
 
-	batches, err := i.GetUserBatchBounds(ctx, configuration.BatchSize+boundModifier)
+	bounds, err := i.GetUserBatchBounds(ctx, configuration.BatchSize+boundModifier)
 	if err != nil {
-		return errors.Wrap(err, "Failed getting user batch bounds")
+		return "", errors.Wrap(err, "Failed getting user batch bounds")
 	}
-	log.Tracef("batches: %+v", batches)
-	var overallError error
-	for _, batch := range batches {
-		start := i.UnqualifiedUsername(batch[0])
-		end := i.UnqualifiedUsername(batch[1])
-		err = amqpClient.PublishContext(ctx, fmt.Sprintf("index.usage.data.batch.user.%s.%s", start, end), []byte{})
-		if err != nil {
-			log.Error(errors.Wrap(err, fmt.Sprintf("Error publishing message for batch %s - %s", start, end)))
-			overallError = err
-			// continue anyway though in case it's specific to this one batch
+	log.Tracef("batches: %+v", bounds)
+
+	batches := make([]jobBatch, 0, len(bounds))
+	for _, b := range bounds {
+		batches = append(batches, jobBatch{
+			start: i.UnqualifiedUsername(b[0]),
+			end:   i.UnqualifiedUsername(b[1]),
+		})
+	}
+
+	return publishJob(ctx, d, t, db.UsageJobFull, batches)
+}
+
+// jobHeartbeatInterval is how often a job running in this process notes that
+// it's still alive, and staleJobAge is how long a job can go without doing so
+// before it's presumed to have died with the process running it.
+const (
+	jobHeartbeatInterval = time.Minute
+	staleJobAge          = 10 * time.Minute
+)
+
+// singlePassTimeout bounds how long a single-pass job may run.
+const singlePassTimeout = 12 * time.Hour
+
+// FailStaleJobs marks jobs that were running in a process that's gone as
+// failed, so they don't show up as running forever. It's meant to be called at
+// startup.
+func FailStaleJobs(ctx context.Context, dedb *sqlx.DB, configuration *config.Config) error {
+	n, err := db.NewDE(dedb, configuration).FailStaleUsageJobs(ctx, staleJobAge)
+	if err != nil {
+		return errors.Wrap(err, "Failed marking stale jobs as failed")
+	}
+	if n > 0 {
+		log.Infof("Marked %d stale jobs as failed", n)
+	}
+	return nil
+}
+
+// StartSinglePassJob starts computing every user's usage in one pass over the
+// ICAT, pushing the results to QMS in chunks of the batch size as they stream
+// in, and returns the ID of the job tracking it. The job runs in the
+// background of this process rather than through the transport, and each chunk
+// is tracked as a batch of the job as it arrives. Users whose QMS update fails
+// are enqueued individually.
+func StartSinglePassJob(ctx context.Context, dedb, icat *sqlx.DB, nc *natsconn.Connector, t transport.Transport, configuration *config.Config) (string, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "StartSinglePassJob")
+	defer span.End()
+
+	d := db.NewDE(dedb, configuration)
+
+	// The chunks aren't known until the rows arrive, so they're added to the
+	// job as they're processed.
+	jobID, err := d.CreateUsageJob(ctx, db.UsageJobFull, 0)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed creating job")
+	}
+
+	err = d.HeartbeatUsageJob(ctx, jobID)
+	if err != nil {
+		log.Error(errors.Wrap(err, fmt.Sprintf("Failed recording heartbeat for job %s", jobID)))
+	}
+
+	// The job outlives whatever started it.
+	runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), singlePassTimeout)
+	go func() {
+		defer cancel()
+		runSinglePass(runCtx, dedb, icat, nc, t, configuration, jobID)
+	}()
+
+	log.Infof("Started single-pass job %s", jobID)
+
+	return jobID, nil
+}
+
+// heartbeat records that the job is still running until the context is done.
+func heartbeat(ctx context.Context, d *db.DEDatabase, jobID string) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.HeartbeatUsageJob(ctx, jobID); err != nil {
+				log.Error(errors.Wrap(err, fmt.Sprintf("Failed recording heartbeat for job %s", jobID)))
+			}
+		}
+	}
+}
+
+func runSinglePass(ctx context.Context, dedb, icat *sqlx.DB, nc *natsconn.Connector, t transport.Transport, configuration *config.Config, jobID string) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "runSinglePass")
+	defer span.End()
+
+	d := db.NewDE(dedb, configuration)
+
+	hbCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go heartbeat(hbCtx, d, jobID)
+
+	began := time.Now()
+	msg := &BatchMessage{JobID: jobID}
+	dbs := db.NewBoth(dedb, icat, configuration, nc)
+
+	chunks := 0
+	var written, skipped, failed, failedChunks int
+	err := dbs.UpdateAllDataUsage(ctx, configuration.BatchSize, func(results []natsconn.UserUpdateResult, pushErr error) error {
+		chunks++
+		if err := d.AddUsageJobBatch(ctx, jobID); err != nil {
+			log.Error(errors.Wrap(err, fmt.Sprintf("Failed recording a new batch for job %s", jobID)))
+		}
+
+		if pushErr != nil {
+			log.Error(errors.Wrap(pushErr, fmt.Sprintf("Single-pass job %s failed chunk %d", jobID, chunks)))
+			failedChunks++
+			recordJobBatch(ctx, dedb, configuration, msg, false, 0, 0)
+			return nil
+		}
+
+		var failedUsers []string
+		var chunkWritten, chunkSkipped int
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				failedUsers = append(failedUsers, r.Username)
+			case r.Skipped:
+				chunkSkipped++
+			default:
+				chunkWritten++
+			}
+		}
+		written += chunkWritten
+		skipped += chunkSkipped
+		failed += len(failedUsers)
+
+		if len(failedUsers) > 0 {
+			if err := requeueUsers(ctx, t, failedUsers); err != nil {
+				log.Error(errors.Wrap(err, "Failed requeueing some users"))
+			}
+		}
+
+		recordJobBatch(ctx, dedb, configuration, msg, true, chunkWritten, chunkSkipped)
+		return nil
+	})
+	if err != nil {
+		// The rest of the pass never ran, so it's recorded as one failed batch.
+		log.Error(errors.Wrap(err, fmt.Sprintf("Single-pass job %s failed after %s and %d chunks", jobID, time.Since(began), chunks)))
+		chunks++
+		failedChunks++
+		if err := d.AddUsageJobBatch(ctx, jobID); err != nil {
+			log.Error(errors.Wrap(err, fmt.Sprintf("Failed recording a new batch for job %s", jobID)))
 		}
+		recordJobBatch(ctx, dedb, configuration, msg, false, 0, 0)
+	}
 
+	err = d.FinishPublishingUsageJob(ctx, jobID, chunks)
+	if err != nil {
+		log.Error(errors.Wrap(err, fmt.Sprintf("Failed recording published batches for job %s", jobID)))
 	}
-	return overallError
+
+	log.Infof("Single-pass job %s finished in %s: %d written to QMS, %d skipped as unchanged, %d failed, %d of %d chunks failed", jobID, time.Since(began), written, skipped, failed, failedChunks, chunks)
+}
+
+// StartFullJob starts a job covering every user, using the configured full
+// refresh mode, and returns the ID of the job tracking it.
+func StartFullJob(ctx context.Context, dedb, icat *sqlx.DB, nc *natsconn.Connector, t transport.Transport, configuration *config.Config) (string, error) {
+	if configuration.FullRefreshMode == config.RefreshModeSinglePass {
+		return StartSinglePassJob(ctx, dedb, icat, nc, t, configuration)
+	}
+	return StartBatchJob(ctx, dedb, icat, t, configuration)
+}
+
+// StartIncrementalJob enqueues batches of only the users whose data changed
+// since the last successful job, and returns the ID of the job tracking their
+// progress. It starts a full job instead if no job has succeeded yet.
+func StartIncrementalJob(ctx context.Context, dedb, icat *sqlx.DB, nc *natsconn.Connector, t transport.Transport, configuration *config.Config) (string, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "StartIncrementalJob")
+	defer span.End()
+
+	i := db.NewICAT(icat, configuration)
+	d := db.NewDE(dedb, configuration)
+
+	since, found, err := d.LastSuccessfulUsageJobTime(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed getting the last successful job")
+	}
+	if !found {
+		log.Info("No job has succeeded yet, so starting a full job instead of an incremental one")
+		return StartFullJob(ctx, dedb, icat, nc, t, configuration)
+	}
+	since = since.Add(-incrementalOverlap)
+
+	changedCtx, cancel := context.WithTimeout(ctx, changedUsersTimeout)
+	defer cancel()
+
+	changed, err := i.ChangedUsers(changedCtx, since)
+	if err != nil && changedCtx.Err() == context.DeadlineExceeded {
+		return "", errors.Wrapf(err, "Timed out after %s getting changed users; check that the ICAT has indexes on r_coll_main.modify_ts and r_data_main.modify_ts", changedUsersTimeout)
+	} else if err != nil {
+		return "", errors.Wrap(err, "Failed getting changed users")
+	}
+	log.Infof("%d users changed since %s", len(changed), since)
+
+	chunks := lo.Chunk(changed, configuration.BatchSize)
+	batches := make([]jobBatch, 0, len(chunks))
+	for _, chunk := range chunks {
+		batches = append(batches, jobBatch{
+			start: chunk[0],
+			end:   chunk[len(chunk)-1],
+			users: chunk,
+		})
+	}
+
+	return publishJob(ctx, d, t, db.UsageJobIncremental, batches)
+}
+
+func SendBatchMessages(ctx context.Context, del transport.Message, dedb, icat *sqlx.DB, nc *natsconn.Connector, t transport.Transport, configuration *config.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	ctx, span := otel.Tracer(otelName).Start(ctx, "SendBatchMessages")
+	defer span.End()
+
+	_, err := StartFullJob(ctx, dedb, icat, nc, t, configuration)
+	return err
 }
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	usageamqp "github.com/cyverse-de/data-usage-api/amqp"
+	"github.com/cyverse-de/data-usage-api/db"
+	"github.com/cyverse-de/data-usage-api/logging"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+func (a *App) RecalculateHandler(c echo.Context) error {
+	start := usageamqp.StartFullJob
+	if v := c.QueryParam("incremental"); v != "" {
+		incremental, err := strconv.ParseBool(v)
+		if err != nil {
+			return logging.ErrorResponse{Message: "incremental must be true or false", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+		if incremental {
+			start = usageamqp.StartIncrementalJob
+		}
+	}
+
+	// Publishing shouldn't stop halfway through just because the client went
+	// away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request().Context()), time.Minute)
+	defer cancel()
+
+	jobID, err := start(ctx, a.dedb, a.icat, a.nc, a.transport, a.configuration)
+	if err != nil && jobID == "" {
+		e := errors.Wrap(err, "Failed starting recalculation")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	} else if err != nil {
+		// Some batches were published, so the job is still worth tracking.
+		log.Error(errors.Wrap(err, "Failed publishing some batches"))
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{"job_id": jobID})
+}
+
+func (a *App) JobStatusHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	id := c.Param("id")
+	if id == "" {
+		return logging.ErrorResponse{Message: "No job ID provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+
+	dedb := db.NewDE(a.dedb, a.configuration)
+	job, err := dedb.GetUsageJob(context, id)
+	if err == sql.ErrNoRows {
+		return logging.ErrorResponse{Message: "No job found with that ID", ErrorCode: "404", HTTPStatusCode: http.StatusNotFound}
+	} else if err != nil {
+		e := errors.Wrap(err, "Failed fetching job")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+func (a *App) ListDeadLettersHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	all := false
+	if v := c.QueryParam("all"); v != "" {
+		var err error
+		all, err = strconv.ParseBool(v)
+		if err != nil {
+			return logging.ErrorResponse{Message: "all must be true or false", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	dedb := db.NewDE(a.dedb, a.configuration)
+	deadLetters, err := dedb.ListDeadLetters(context, all)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching dead letters")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"dead_letters": deadLetters})
+}
+
+// replayDeadLetter publishes the dead letter's message again, outside of any
+// job it was part of, and marks it as replayed.
+func (a *App) replayDeadLetter(context context.Context, dedb *db.DEDatabase, dl *db.DeadLetter) error {
+	body, err := usageamqp.ReplayBody(dl.RoutingKey, dl.Body)
+	if err != nil {
+		return errors.Wrapf(err, "Failed preparing dead letter %s for replay", dl.ID)
+	}
+
+	err = a.transport.Publish(context, dl.RoutingKey, body)
+	if err != nil {
+		return errors.Wrapf(err, "Failed republishing dead letter %s", dl.ID)
+	}
+	return dedb.MarkDeadLetterReplayed(context, dl.ID)
+}
+
+func (a *App) ReplayDeadLetterHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	id := c.Param("id")
+	if id == "" {
+		return logging.ErrorResponse{Message: "No dead letter ID provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+
+	dedb := db.NewDE(a.dedb, a.configuration)
+	dl, err := dedb.GetDeadLetter(context, id)
+	if err == sql.ErrNoRows {
+		return logging.ErrorResponse{Message: "No dead letter found with that ID", ErrorCode: "404", HTTPStatusCode: http.StatusNotFound}
+	} else if err != nil {
+		e := errors.Wrap(err, "Failed fetching dead letter")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	if err = a.replayDeadLetter(context, dedb, dl); err != nil {
+		log.Error(err)
+		return logging.ErrorResponse{Message: err.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"replayed": dl.ID})
+}
+
+func (a *App) ReplayAllDeadLettersHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	dedb := db.NewDE(a.dedb, a.configuration)
+	deadLetters, err := dedb.ListDeadLetters(context, false)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching dead letters")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	replayed := make([]string, 0, len(deadLetters))
+	failed := make(map[string]string)
+	for i := range deadLetters {
+		dl := &deadLetters[i]
+		if err = a.replayDeadLetter(context, dedb, dl); err != nil {
+			log.Error(err)
+			failed[dl.ID] = err.Error()
+			continue
+		}
+		replayed = append(replayed, dl.ID)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"replayed": replayed,
+		"failed":   failed,
+	})
+}
+
+// zoneScanTimeout bounds the reports that scan the whole zone.
+const zoneScanTimeout = 15 * time.Minute
+
+// zoneScan runs a zone-wide report, sharing the result with any identical
+// request already running rather than starting another scan. The scan isn't
+// cancelled if the request that started it goes away, since others may be
+// waiting on it, but it's bounded by zoneScanTimeout.
+func (a *App) zoneScan(ctx context.Context, key string, scan func(context.Context) (interface{}, error)) (interface{}, error) {
+	ch := a.zoneScans.DoChan(key, func() (interface{}, error) {
+		scanCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), zoneScanTimeout)
+		defer cancel()
+		return scan(scanCtx)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.Val, res.Err
+	}
+}
+
+// defaultComparisonLimit is how many users the attribution comparison returns
+// when no limit is given.
+const defaultComparisonLimit = 100
+
+func (a *App) AttributionComparisonHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var limit uint64 = defaultComparisonLimit
+	if v := c.QueryParam("limit"); v != "" {
+		var err error
+		limit, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return logging.ErrorResponse{Message: "limit must be a non-negative integer", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	differences, err := a.zoneScan(ctx, fmt.Sprintf("attribution-comparison/%d", limit), func(scanCtx context.Context) (interface{}, error) {
+		return db.NewBoth(a.dedb, a.icat, a.configuration, a.nc).CompareAttribution(scanCtx, limit)
+	})
+	if err != nil {
+		e := errors.Wrap(err, "Failed comparing attribution modes")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"attribution": a.configuration.Attribution,
+		"users":       differences,
+	})
+}
+
+func (a *App) ZoneDataAgeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	res, err := a.zoneScan(ctx, "data-age", func(scanCtx context.Context) (interface{}, error) {
+		return db.NewBoth(a.dedb, a.icat, a.configuration, a.nc).ZoneDataAgeBuckets(scanCtx)
+	})
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching zone-wide data age buckets")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	usageamqp "github.com/cyverse-de/data-usage-api/amqp"
+	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/data-usage-api/db"
+	"github.com/cyverse-de/data-usage-api/transport"
+	"github.com/jmoiron/sqlx"
+)
+
+// publishedMessage is a message sent through recordingTransport.
+type publishedMessage struct {
+	key  string
+	body []byte
+}
+
+// recordingTransport records the messages published through it.
+type recordingTransport struct {
+	published []publishedMessage
+}
+
+func (t *recordingTransport) EnqueueUserUpdate(ctx context.Context, username string) error {
+	return t.Publish(ctx, transport.UserKey(username), []byte{})
+}
+
+func (t *recordingTransport) EnqueueBatch(ctx context.Context, start, end string, body []byte) error {
+	return t.Publish(ctx, transport.BatchKey(start, end), body)
+}
+
+func (t *recordingTransport) Publish(_ context.Context, key string, body []byte) error {
+	t.published = append(t.published, publishedMessage{key: key, body: body})
+	return nil
+}
+
+func (t *recordingTransport) Listen(transport.Handler) error { return nil }
+
+func (t *recordingTransport) Close() {}
+
+// recordingDB records the statements executed against it.
+type recordingDB struct {
+	statements []string
+}
+
+func (d *recordingDB) QueryRowxContext(context.Context, string, ...interface{}) *sqlx.Row {
+	return nil
+}
+
+func (d *recordingDB) QueryxContext(context.Context, string, ...interface{}) (*sqlx.Rows, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (d *recordingDB) ExecContext(_ context.Context, query string, _ ...interface{}) (sql.Result, error) {
+	d.statements = append(d.statements, query)
+	return nil, nil
+}
+
+func (d *recordingDB) GetContext(context.Context, interface{}, string, ...interface{}) error {
+	return sql.ErrNoRows
+}
+
+func (d *recordingDB) SelectContext(context.Context, interface{}, string, ...interface{}) error {
+	return nil
+}
+
+func TestReplayDeadLetterOfFinishedJob(t *testing.T) {
+	cfg := &config.Config{DBSchema: "public"}
+	tr := &recordingTransport{}
+	a := &App{transport: tr, configuration: cfg}
+	rdb := &recordingDB{}
+
+	// The batch was dead-lettered as part of a job that has since finished.
+	body, err := json.Marshal(&usageamqp.BatchMessage{JobID: "finished-job", Users: []string{"alice", "bob"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dl := &db.DeadLetter{
+		ID:         "dead-letter",
+		RoutingKey: transport.BatchKey("alice", "bob"),
+		Body:       body,
+	}
+
+	if err = a.replayDeadLetter(context.Background(), db.NewDE(rdb, cfg), dl); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(tr.published) != 1 {
+		t.Fatalf("expected one published message, got %d", len(tr.published))
+	}
+	if tr.published[0].key != dl.RoutingKey {
+		t.Errorf("expected key %s, got %s", dl.RoutingKey, tr.published[0].key)
+	}
+
+	var replayed usageamqp.BatchMessage
+	if err = json.Unmarshal(tr.published[0].body, &replayed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replayed.JobID != "" {
+		t.Errorf("expected the replayed batch to have no job, got %s", replayed.JobID)
+	}
+	if strings.Join(replayed.Users, ",") != "alice,bob" {
+		t.Errorf("expected the replayed batch to keep its users, got %v", replayed.Users)
+	}
+
+	for _, stmt := range rdb.statements {
+		if strings.Contains(stmt, "data_usage_jobs") {
+			t.Errorf("expected the finished job to be left alone, got %s", stmt)
+		}
+	}
+	if len(rdb.statements) != 1 || !strings.Contains(rdb.statements[0], "data_usage_dead_letters") {
+		t.Errorf("expected only the dead letter to be marked as replayed, got %v", rdb.statements)
+	}
+}
+
+func TestReplayBodyLeavesOtherMessagesAlone(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		body []byte
+	}{
+		{name: "user update", key: transport.UserKey("alice"), body: []byte{}},
+		{name: "batch without a body", key: transport.BatchKey("alice", "bob"), body: []byte{}},
+		{name: "batch without a job", key: transport.BatchKey("alice", "bob"), body: []byte(`{"users":["alice"]}`)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := usageamqp.ReplayBody(tc.key, tc.body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(body) != string(tc.body) {
+				t.Errorf("expected %q, got %q", tc.body, body)
+			}
+		})
+	}
+}
@@ -1,14 +1,18 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/cyverse-de/data-usage-api/config"
 	"github.com/cyverse-de/data-usage-api/logging"
 	"github.com/cyverse-de/data-usage-api/natsconn"
-	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/data-usage-api/transport"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"golang.org/x/sync/singleflight"
 )
 
 // nolint - for now
@@ -18,17 +22,21 @@ type App struct {
 	dedb          *sqlx.DB
 	icat          *sqlx.DB
 	router        *echo.Echo
-	amqp          *messaging.Client
+	transport     transport.Transport
 	nc            *natsconn.Connector
 	configuration *config.Config
+
+	// zoneScans keeps concurrent requests for the same zone-wide report from
+	// each scanning the ICAT.
+	zoneScans singleflight.Group
 }
 
-func New(dedb *sqlx.DB, icat *sqlx.DB, amqp *messaging.Client, nc *natsconn.Connector, configuration *config.Config) *App {
+func New(dedb *sqlx.DB, icat *sqlx.DB, t transport.Transport, nc *natsconn.Connector, configuration *config.Config) *App {
 	return &App{
 		dedb:          dedb,
 		icat:          icat,
 		router:        echo.New(),
-		amqp:          amqp,
+		transport:     t,
 		nc:            nc,
 		configuration: configuration,
 	}
@@ -40,10 +48,38 @@ func (a *App) Router() *echo.Echo {
 	a.router.HTTPErrorHandler = logging.HTTPErrorHandler
 	a.router.GET("/", a.GreetingHandler).Name = "greeting"
 
+	a.router.POST("/data/current", a.BulkCurrentUsageHandler)
+
+	admin := a.router.Group("/admin")
+	admin.POST("/recalculate", a.RecalculateHandler)
+	admin.GET("/jobs/:id", a.JobStatusHandler)
+	admin.GET("/dead-letters", a.ListDeadLettersHandler)
+	admin.POST("/dead-letters/replay", a.ReplayAllDeadLettersHandler)
+	admin.POST("/dead-letters/:id/replay", a.ReplayDeadLetterHandler)
+	admin.GET("/attribution-comparison", a.AttributionComparisonHandler)
+	admin.GET("/data-age", a.ZoneDataAgeHandler)
+
 	userdata := a.router.Group("/:username/data")
 	userdata.GET("/current", a.UserCurrentUsageHandler)
 	userdata.POST("/update", a.UpdateUserCurrentUsageHandler)
 	userdata.GET("/overage", a.UserDataOverageHandler)
+	userdata.GET("/by-resource", a.UserUsageByResourceHandler)
+	userdata.GET("/types", a.UserUsageByTypeHandler)
+	userdata.GET("/folders", a.UserFolderSizesHandler)
+	userdata.GET("/largest", a.UserLargestDataObjectsHandler)
+	userdata.GET("/age", a.UserDataAgeHandler)
+	userdata.GET("/history", a.UserUsageHistoryHandler)
+	userdata.GET("/forecast", a.UserQuotaForecastHandler)
+	userdata.GET("/quota", a.UserQuotaStatusHandler)
 
 	return a.router
 }
+
+// qmsErrorResponse converts an error from an operation that talks to QMS into
+// an error response, reporting QMS outages as a 503 rather than a 500.
+func qmsErrorResponse(err error) logging.ErrorResponse {
+	if errors.Is(err, natsconn.ErrQMSUnavailable) {
+		return logging.ErrorResponse{Message: natsconn.ErrQMSUnavailable.Error(), ErrorCode: "503", HTTPStatusCode: http.StatusServiceUnavailable}
+	}
+	return logging.ErrorResponse{Message: err.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/db"
+	"github.com/cyverse-de/data-usage-api/forecast"
+	"github.com/cyverse-de/data-usage-api/logging"
+	"github.com/cyverse-de/data-usage-api/util"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const defaultForecastDays = 90
+
+// QuotaForecast is the estimate of when a user will cross their data.size
+// quota. Confidence is the coefficient of determination (R²) of the growth
+// trend, from 0 (no fit) to 1 (perfect fit). A forecast is only available once
+// there are forecast.MinPoints daily readings spanning forecast.MinSpan, and
+// flat usage has no confidence since it shows no trend.
+type QuotaForecast struct {
+	Username          string     `json:"username"`
+	Quota             float64    `json:"quota"`
+	Usage             int64      `json:"usage"`
+	GrowthPerDay      float64    `json:"growth_bytes_per_day"`
+	EstimatedDate     *time.Time `json:"estimated_date"`
+	Confidence        float64    `json:"confidence"`
+	ReadingsUsed      int        `json:"readings_used"`
+	AlreadyOverQuota  bool       `json:"already_over_quota"`
+	ForecastAvailable bool       `json:"forecast_available"`
+}
+
+func (a *App) UserQuotaForecastHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	days := defaultForecastDays
+	if d := c.QueryParam("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days < 1 {
+			return logging.ErrorResponse{Message: "days must be a positive integer", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	quota, err := a.nc.UserDataQuota(context, a.configuration, user)
+	if err == sql.ErrNoRows {
+		return logging.ErrorResponse{Message: "No data quota found for user", ErrorCode: "404", HTTPStatusCode: http.StatusNotFound}
+	} else if err != nil {
+		e := errors.Wrap(err, "Failed fetching data quota")
+		log.Error(e)
+		return qmsErrorResponse(e)
+	}
+
+	now := time.Now()
+	dedb := db.NewDE(a.dedb, a.configuration)
+	readings, err := dedb.UsageHistory(context, user, now.AddDate(0, 0, -days), now, "day")
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching usage history")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	if len(readings) == 0 {
+		return logging.ErrorResponse{Message: "No usage history found for user", ErrorCode: "404", HTTPStatusCode: http.StatusNotFound}
+	}
+
+	res := &QuotaForecast{
+		Username:     user,
+		Quota:        quota,
+		Usage:        readings[len(readings)-1].Total,
+		ReadingsUsed: len(readings),
+	}
+
+	if float64(res.Usage) >= quota {
+		res.AlreadyOverQuota = true
+		return c.JSON(http.StatusOK, res)
+	}
+
+	points := make([]forecast.Point, 0, len(readings))
+	for _, r := range readings {
+		points = append(points, forecast.Point{Time: r.RecordedAt, Value: float64(r.Total)})
+	}
+
+	trend, err := forecast.Fit(points)
+	if err == forecast.ErrNotEnoughPoints {
+		return c.JSON(http.StatusOK, res)
+	} else if err != nil {
+		e := errors.Wrap(err, "Failed fitting usage trend")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	res.ForecastAvailable = true
+	res.GrowthPerDay = trend.PerDay()
+	res.Confidence = trend.RSquared
+	if when, ok := trend.When(quota); ok {
+		// The fitted line can cross the quota before the latest reading does.
+		if when.Before(now) {
+			when = now
+		}
+		res.EstimatedDate = &when
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/db"
+	"github.com/cyverse-de/data-usage-api/logging"
+	"github.com/cyverse-de/data-usage-api/util"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const defaultHistoryWindow = 30 * 24 * time.Hour
+
+// parseHistoryTime accepts either a full RFC 3339 timestamp or a plain date,
+// which is taken as the start of that day.
+func parseHistoryTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// parseHistoryEnd is like parseHistoryTime, but for the exclusive end of a
+// range. A plain date is taken as the end of that day, so that readings taken
+// on it are included.
+func parseHistoryEnd(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.DateOnly, value)
+	if err != nil {
+		return t, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+func (a *App) UserUsageHistoryHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	var err error
+
+	to := time.Now()
+	if v := c.QueryParam("to"); v != "" {
+		to, err = parseHistoryEnd(v)
+		if err != nil {
+			return logging.ErrorResponse{Message: "to must be an RFC 3339 timestamp or a YYYY-MM-DD date", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	from := to.Add(-defaultHistoryWindow)
+	if v := c.QueryParam("from"); v != "" {
+		from, err = parseHistoryTime(v)
+		if err != nil {
+			return logging.ErrorResponse{Message: "from must be an RFC 3339 timestamp or a YYYY-MM-DD date", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	if from.After(to) {
+		return logging.ErrorResponse{Message: "from must not be after to", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+
+	interval := c.QueryParam("interval")
+	if interval != "" && !db.ValidHistoryInterval(interval) {
+		return logging.ErrorResponse{Message: "interval must be one of hour, day, week, month or year", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+
+	dedb := db.NewDE(a.dedb, a.configuration)
+	readings, err := dedb.UsageHistory(context, user, from, to, interval)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching usage history")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username": user,
+		"from":     from,
+		"to":       to,
+		"interval": interval,
+		"readings": readings,
+	})
+}
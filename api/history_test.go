@@ -0,0 +1,66 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHistoryRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		start time.Time
+		end   time.Time
+	}{
+		{
+			name:  "date",
+			value: "2026-10-15",
+			start: time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "end of month",
+			value: "2026-10-31",
+			start: time.Date(2026, time.October, 31, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "timestamp",
+			value: "2026-10-15T12:30:00Z",
+			start: time.Date(2026, time.October, 15, 12, 30, 0, 0, time.UTC),
+			end:   time.Date(2026, time.October, 15, 12, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start, err := parseHistoryTime(tc.value)
+			if err != nil {
+				t.Fatalf("unexpected error parsing the start: %v", err)
+			}
+			if !start.Equal(tc.start) {
+				t.Errorf("expected start %s, got %s", tc.start, start)
+			}
+
+			end, err := parseHistoryEnd(tc.value)
+			if err != nil {
+				t.Fatalf("unexpected error parsing the end: %v", err)
+			}
+			if !end.Equal(tc.end) {
+				t.Errorf("expected end %s, got %s", tc.end, end)
+			}
+		})
+	}
+
+	// A reading taken during the day given as the end of a range falls
+	// before the exclusive end.
+	end, _ := parseHistoryEnd("2026-10-15")
+	reading := time.Date(2026, time.October, 15, 18, 0, 0, 0, time.UTC)
+	if !reading.Before(end) {
+		t.Errorf("expected a reading at %s to fall before %s", reading, end)
+	}
+
+	if _, err := parseHistoryEnd("15/10/2026"); err == nil {
+		t.Error("expected an error for an unrecognized date")
+	}
+}
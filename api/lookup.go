@@ -1,50 +1,56 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
-	"strings"
+	"path"
+	"strconv"
 	"time"
 
 	"github.com/cyverse-de/data-usage-api/db"
 	"github.com/cyverse-de/data-usage-api/logging"
+	"github.com/cyverse-de/data-usage-api/natsconn"
 	"github.com/cyverse-de/data-usage-api/util"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
-func (a *App) UserCurrentUsageHandler(c echo.Context) error {
-	context := c.Request().Context()
-
-	user := c.Param("username")
-	if user == "" {
-		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+// enqueueUserUpdate asynchronously requests a recalculation of the user's
+// usage. Failures are logged rather than returned, since callers only do this
+// opportunistically.
+func (a *App) enqueueUserUpdate(context context.Context, user string) {
+	log.Tracef("Enqueuing update message for %s", user)
+	err := a.transport.EnqueueUserUpdate(context, user)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed enqueuing update message"))
 	}
-	user = util.FixUsername(user, a.configuration)
+}
 
+// currentUsage looks up the user's current usage in QMS and enqueues an
+// asynchronous update if it's missing or stale. The user should already be
+// domain-qualified. Errors are returned as logging.ErrorResponse values.
+func (a *App) currentUsage(context context.Context, user string) (*natsconn.UserDataUsage, error) {
 	// Get user info from the DE database. Used below to fill out some fields
 	// in the response.
-	db := db.NewDE(a.dedb, a.configuration)
-	userInfo, err := db.GetUserInfo(context, user)
+	dedb := db.NewDE(a.dedb, a.configuration)
+	userInfo, err := dedb.GetUserInfo(context, user)
 	if err != nil {
-		return logging.ErrorResponse{Message: err.Error(), ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		return nil, logging.ErrorResponse{Message: err.Error(), ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
 	}
 
 	// Get the current usage as recorded in QMS.
 	res, err := a.nc.UserCurrentDataUsage(context, a.configuration, user)
 
 	if err == sql.ErrNoRows {
-		log.Tracef("Enqueuing update message for %s", user)
-		err = a.amqp.PublishContext(context, fmt.Sprintf("index.usage.data.user.%s", strings.TrimSuffix(user, "@"+a.configuration.UserSuffix)), []byte{})
-		if err != nil {
-			log.Error(errors.Wrap(err, "Failed enqueuing update message"))
-		}
-		return logging.ErrorResponse{Message: "No data usage information found for user", ErrorCode: "404", HTTPStatusCode: http.StatusNotFound}
+		a.enqueueUserUpdate(context, user)
+		return nil, logging.ErrorResponse{Message: "No data usage information found for user", ErrorCode: "404", HTTPStatusCode: http.StatusNotFound}
 	} else if err != nil {
 		e := errors.Wrap(err, "Failed fetching current usage")
 		log.Error(e)
-		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+		return nil, qmsErrorResponse(e)
 	}
 
 	// QMS response contains user info from QMS, which does not necessarily
@@ -53,19 +59,119 @@ func (a *App) UserCurrentUsageHandler(c echo.Context) error {
 	res.UserID = userInfo.ID
 	res.Username = userInfo.Username
 
+	// QMS only knows the total, so the breakdown comes from the reading that
+	// was recorded when the total was pushed. It's left out if QMS has a
+	// different total, since it wouldn't add up.
+	reading, err := dedb.LatestUsageReading(context, user)
+	if err != nil && err != sql.ErrNoRows {
+		e := errors.Wrap(err, "Failed fetching usage breakdown")
+		log.Error(e)
+		return nil, logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+	if err == nil && reading.Total == res.Total {
+		res.UsageBreakdown = reading.Breakdown
+	}
+
 	// if the user's usage information is older than the refresh interval, asynchronously update it
 	if res.Time.Add(*a.configuration.RefreshInterval).Before(time.Now()) {
 		// enqueue async update
-		log.Tracef("Enqueuing update message for %s", user)
-		err = a.amqp.PublishContext(context, fmt.Sprintf("index.usage.data.user.%s", strings.TrimSuffix(user, "@"+a.configuration.UserSuffix)), []byte{})
-		if err != nil {
-			log.Error(errors.Wrap(err, "Failed enqueuing update message"))
-		}
+		a.enqueueUserUpdate(context, user)
+	}
+
+	return res, nil
+}
+
+func (a *App) UserCurrentUsageHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	res, err := a.currentUsage(context, user)
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, res)
 }
 
+// BulkUsageRequest is the request body for looking up many users' current
+// usage at once.
+type BulkUsageRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// BulkUsageResult is the outcome of looking up a single user's current usage
+// as part of a bulk request. Exactly one of Usage and Error is set.
+type BulkUsageResult struct {
+	Username string                  `json:"username"`
+	Usage    *natsconn.UserDataUsage `json:"usage,omitempty"`
+	Error    *logging.ErrorResponse  `json:"error,omitempty"`
+}
+
+// maxBulkUsers limits how many users can be looked up in one bulk request, so
+// that a request finishes well within a typical client timeout.
+const maxBulkUsers = 200
+
+// BulkCurrentUsageHandler looks up the current usage for many users at once.
+// Users are looked up concurrently, up to config.QMSBatchConcurrency at a time,
+// and results are returned in the order the users were requested.
+func (a *App) BulkCurrentUsageHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req BulkUsageRequest
+	if err := c.Bind(&req); err != nil {
+		return logging.ErrorResponse{Message: "Request body must be a JSON object with a usernames list", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+
+	if len(req.Usernames) == 0 {
+		return logging.ErrorResponse{Message: "No usernames provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+
+	if len(req.Usernames) > maxBulkUsers {
+		return logging.ErrorResponse{Message: fmt.Sprintf("At most %d usernames may be requested at once", maxBulkUsers), ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+
+	users := make([]string, 0, len(req.Usernames))
+	seen := make(map[string]bool)
+	for _, username := range req.Usernames {
+		if username == "" {
+			continue
+		}
+		user := util.FixUsername(username, a.configuration)
+		if seen[user] {
+			continue
+		}
+		seen[user] = true
+		users = append(users, user)
+	}
+
+	results := make([]BulkUsageResult, len(users))
+	var g errgroup.Group
+	g.SetLimit(a.configuration.QMSBatchConcurrency)
+	for i, user := range users {
+		g.Go(func() error {
+			result := BulkUsageResult{Username: user}
+			res, err := a.currentUsage(ctx, user)
+			if err != nil {
+				e := logging.NewErrorResponse(err)
+				result.Error = &e
+			} else {
+				result.Usage = res
+			}
+			results[i] = result
+			// Errors are reported per user rather than failing the request.
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"users": results})
+}
+
 func (a *App) UserDataOverageHandler(c echo.Context) error {
 	context := c.Request().Context()
 
@@ -75,20 +181,225 @@ func (a *App) UserDataOverageHandler(c echo.Context) error {
 	}
 	user = util.FixUsername(user, a.configuration)
 
-	overages, err := a.nc.AllResourceOveragesForUser(context, a.configuration, user)
+	detail := false
+	if d := c.QueryParam("detail"); d != "" {
+		var err error
+		detail, err = strconv.ParseBool(d)
+		if err != nil {
+			return logging.ErrorResponse{Message: "detail must be true or false", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	// Older clients only understand the boolean, which doesn't need the
+	// lookup of units that the detailed overages do.
+	if !detail {
+		overages, err := a.nc.AllResourceOveragesForUser(context, a.configuration, user)
+		if err != nil {
+			e := errors.Wrap(err, "failed getting all resource overages")
+			log.Error(e)
+			return qmsErrorResponse(e)
+		}
+
+		hasDataOverage := false
+
+		for _, overage := range overages.Overages {
+			if overage.ResourceName == "data.size" {
+				hasDataOverage = true
+			}
+		}
+
+		return c.JSON(http.StatusOK, map[string]bool{"has_data_overage": hasDataOverage})
+	}
+
+	overages, err := a.nc.DetailedOveragesForUser(context, a.configuration, user)
 	if err != nil {
 		e := errors.Wrap(err, "failed getting all resource overages")
 		log.Error(e)
-		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+		return qmsErrorResponse(e)
 	}
 
 	hasDataOverage := false
 
-	for _, overage := range overages.Overages {
+	for _, overage := range overages {
 		if overage.ResourceName == "data.size" {
 			hasDataOverage = true
 		}
 	}
 
-	return c.JSON(http.StatusOK, map[string]bool{"has_data_overage": hasDataOverage})
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username":         user,
+		"has_data_overage": hasDataOverage,
+		"overages":         overages,
+	})
+}
+
+func (a *App) UserUsageByResourceHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	dbs := db.NewBoth(a.dedb, a.icat, a.configuration, a.nc)
+
+	res, err := dbs.UserDataUsageByResource(context, user)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching usage by resource")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (a *App) UserUsageByTypeHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	dbs := db.NewBoth(a.dedb, a.icat, a.configuration, a.nc)
+
+	res, err := dbs.UserDataUsageByType(context, user)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching usage by type")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (a *App) UserFolderSizesHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	// Cleaning a rooted path removes any .. elements, so the result can't
+	// escape the user's home collection.
+	subpath := path.Clean("/" + c.QueryParam("path"))
+
+	depth := 1
+	if d := c.QueryParam("depth"); d != "" {
+		var err error
+		depth, err = strconv.Atoi(d)
+		if err != nil || depth < 1 {
+			return logging.ErrorResponse{Message: "depth must be a positive integer", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	dbs := db.NewBoth(a.dedb, a.icat, a.configuration, a.nc)
+
+	folders, err := dbs.UserFolderSizes(context, user, subpath, depth)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching folder sizes")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username": user,
+		"path":     subpath,
+		"depth":    depth,
+		"folders":  folders,
+	})
+}
+
+// defaultLargestLimit is how many data objects the largest data objects report
+// returns when no limit is given, and maxLargestLimit is the most it returns.
+const (
+	defaultLargestLimit = 20
+	maxLargestLimit     = 1000
+)
+
+func (a *App) UserLargestDataObjectsHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	var limit uint64 = defaultLargestLimit
+	if v := c.QueryParam("limit"); v != "" {
+		var err error
+		limit, err = strconv.ParseUint(v, 10, 64)
+		if err != nil || limit < 1 {
+			return logging.ErrorResponse{Message: "limit must be a positive integer", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+		if limit > maxLargestLimit {
+			return logging.ErrorResponse{Message: fmt.Sprintf("limit must be at most %d", maxLargestLimit), ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+		}
+	}
+
+	dbs := db.NewBoth(a.dedb, a.icat, a.configuration, a.nc)
+
+	objects, err := dbs.UserLargestDataObjects(context, user, limit)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching largest data objects")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username":     user,
+		"limit":        limit,
+		"data_objects": objects,
+	})
+}
+
+func (a *App) UserDataAgeHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	dbs := db.NewBoth(a.dedb, a.icat, a.configuration, a.nc)
+
+	res, err := dbs.UserDataAgeBuckets(context, user)
+	if err != nil {
+		e := errors.Wrap(err, "Failed fetching data age buckets")
+		log.Error(e)
+		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (a *App) UserQuotaStatusHandler(c echo.Context) error {
+	context := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return logging.ErrorResponse{Message: "No username provided", ErrorCode: "400", HTTPStatusCode: http.StatusBadRequest}
+	}
+	user = util.FixUsername(user, a.configuration)
+
+	res, usageFound, err := a.nc.UserDataQuotaStatus(context, a.configuration, user)
+	if err == sql.ErrNoRows {
+		return logging.ErrorResponse{Message: "No data quota found for user", ErrorCode: "404", HTTPStatusCode: http.StatusNotFound}
+	} else if err != nil {
+		e := errors.Wrap(err, "Failed fetching quota status")
+		log.Error(e)
+		return qmsErrorResponse(e)
+	}
+
+	if !usageFound {
+		a.enqueueUserUpdate(context, user)
+	}
+
+	return c.JSON(http.StatusOK, res)
 }
@@ -21,11 +21,11 @@ func (a *App) UpdateUserCurrentUsageHandler(c echo.Context) error {
 
 	dbs := db.NewBoth(a.dedb, a.icat, a.configuration, a.nc)
 
-	res, err := dbs.UpdateUserDataUsage(context, user)
+	res, err := dbs.UpdateUserDataUsage(context, user, db.UsageSourceManual)
 	if err != nil {
 		e := errors.Wrap(err, "Failed updating usage information")
 		log.Error(e)
-		return logging.ErrorResponse{Message: e.Error(), ErrorCode: "500", HTTPStatusCode: http.StatusInternalServerError}
+		return qmsErrorResponse(e)
 	}
 
 	return c.JSON(http.StatusOK, res)
@@ -8,6 +8,46 @@ import (
 	"github.com/spf13/viper"
 )
 
+// The ways a full refresh can compute usage. Batch mode splits users into
+// ranges that are sent through the transport to be recomputed separately,
+// while single-pass mode computes everyone in one query, streaming the results
+// to QMS from the process that started the refresh.
+const (
+	RefreshModeBatch      = "batch"
+	RefreshModeSinglePass = "single-pass"
+)
+
+// How data objects are attributed to users. Path attribution charges users
+// for the data in their home and trash collections, while owner attribution
+// charges them for the data objects they own, wherever they are. Owner
+// attribution requires an index on r_data_main (data_owner_name,
+// data_owner_zone) in the ICAT, which the service checks for at startup.
+const (
+	AttributionPath  = "path"
+	AttributionOwner = "owner"
+)
+
+// How replicated data objects are sized. Logical accounting counts one replica
+// of each data object, while physical accounting counts every replica.
+const (
+	SizeLogical  = "logical"
+	SizePhysical = "physical"
+)
+
+// How data under /<zone>/home/shared is attributed in path mode. By default it isn't
+// charged to anyone; in owner mode it's charged to the owner of the collection
+// it's in.
+const (
+	SharedAttributionNone  = "none"
+	SharedAttributionOwner = "owner"
+)
+
+// The transports that work messages can be sent through.
+const (
+	TransportAMQP      = "amqp"
+	TransportJetStream = "jetstream"
+)
+
 type Config struct {
 	DBURI    string
 	DBSchema string
@@ -15,15 +55,39 @@ type Config struct {
 	ICATURI           string
 	Zone              string
 	RootResourceNames []string
+	Attribution       string
+	SharedAttribution string
+	SizeAccounting    string
 
 	UserSuffix      string
 	RefreshInterval *time.Duration
+	RefreshSchedule string
+
+	IncrementalSchedule string
+	FullRefreshMode     string
+
+	UpdateWorkers   int
+	UpdateQueueSize int
+
+	Transport              string
+	JetStreamStream        string
+	JetStreamSubjectPrefix string
+	JetStreamMaxAckPending int
 
 	AMQPURI          string
 	AMQPExchangeName string
 	AMQPExchangeType string
 	AMQPQueuePrefix  string
 	BatchSize        int
+
+	QMSRetries          int
+	QMSRetryBaseDelay   time.Duration
+	QMSRetryMaxDelay    time.Duration
+	QMSBreakerThreshold int
+	QMSBreakerCooldown  time.Duration
+	QMSBatchConcurrency int
+	QMSForceWriteAfter  time.Duration
+	QMSPushObjectCounts bool
 }
 
 func NewFromViper(cfg *viper.Viper) (*Config, error) {
@@ -31,19 +95,58 @@ func NewFromViper(cfg *viper.Viper) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	retryBase, err := time.ParseDuration(cfg.GetString("qms.retryBaseDelay"))
+	if err != nil {
+		return nil, err
+	}
+	retryMax, err := time.ParseDuration(cfg.GetString("qms.retryMaxDelay"))
+	if err != nil {
+		return nil, err
+	}
+	breakerCooldown, err := time.ParseDuration(cfg.GetString("qms.breakerCooldown"))
+	if err != nil {
+		return nil, err
+	}
+	forceWriteAfter, err := time.ParseDuration(cfg.GetString("qms.forceWriteAfter"))
+	if err != nil {
+		return nil, err
+	}
 	c := &Config{
 		DBURI:             cfg.GetString("db.uri"),
 		DBSchema:          cfg.GetString("db.schema"),
 		ICATURI:           cfg.GetString("icat.uri"),
 		Zone:              cfg.GetString("icat.zone"),
 		RootResourceNames: cfg.GetStringSlice("icat.rootResources"),
+		Attribution:       cfg.GetString("icat.attribution"),
+		SharedAttribution: cfg.GetString("icat.sharedAttribution"),
+		SizeAccounting:    cfg.GetString("icat.sizeAccounting"),
 		UserSuffix:        strings.Trim(cfg.GetString("users.domain"), "@"),
 		RefreshInterval:   &ri,
+		RefreshSchedule:   cfg.GetString("dataUsageApi.refreshSchedule"),
+		Transport:         cfg.GetString("transport.type"),
 		AMQPURI:           cfg.GetString("amqp.uri"),
 		AMQPExchangeName:  cfg.GetString("amqp.exchange.name"),
 		AMQPExchangeType:  cfg.GetString("amqp.exchange.type"),
 		AMQPQueuePrefix:   cfg.GetString("amqp.queue_prefix"),
 		BatchSize:         cfg.GetInt("amqp.batch_size"),
+
+		IncrementalSchedule: cfg.GetString("dataUsageApi.incrementalSchedule"),
+		FullRefreshMode:     cfg.GetString("dataUsageApi.fullRefreshMode"),
+		UpdateWorkers:       cfg.GetInt("dataUsageApi.updateWorkers"),
+		UpdateQueueSize:     cfg.GetInt("dataUsageApi.updateQueueSize"),
+
+		JetStreamStream:        cfg.GetString("transport.jetstream.stream"),
+		JetStreamSubjectPrefix: cfg.GetString("transport.jetstream.subjectPrefix"),
+		JetStreamMaxAckPending: cfg.GetInt("transport.jetstream.maxAckPending"),
+
+		QMSRetries:          cfg.GetInt("qms.retries"),
+		QMSRetryBaseDelay:   retryBase,
+		QMSRetryMaxDelay:    retryMax,
+		QMSBreakerThreshold: cfg.GetInt("qms.breakerThreshold"),
+		QMSBreakerCooldown:  breakerCooldown,
+		QMSBatchConcurrency: cfg.GetInt("qms.batchConcurrency"),
+		QMSForceWriteAfter:  forceWriteAfter,
+		QMSPushObjectCounts: cfg.GetBool("qms.pushObjectCounts"),
 	}
 
 	err = c.Validate()
@@ -74,6 +177,18 @@ func (c *Config) Validate() error {
 		return errors.New("icat.rootResources must be set")
 	}
 
+	if c.Attribution != AttributionPath && c.Attribution != AttributionOwner {
+		return errors.New("icat.attribution must be path or owner")
+	}
+
+	if c.SharedAttribution != SharedAttributionNone && c.SharedAttribution != SharedAttributionOwner {
+		return errors.New("icat.sharedAttribution must be none or owner")
+	}
+
+	if c.SizeAccounting != SizeLogical && c.SizeAccounting != SizePhysical {
+		return errors.New("icat.sizeAccounting must be logical or physical")
+	}
+
 	if c.UserSuffix == "" {
 		return errors.New("users.domain must be set")
 	}
@@ -82,16 +197,65 @@ func (c *Config) Validate() error {
 		return errors.New("refresh interval must be set")
 	}
 
-	if c.AMQPURI == "" {
-		return errors.New("amqp.uri must be set")
+	if c.FullRefreshMode != RefreshModeBatch && c.FullRefreshMode != RefreshModeSinglePass {
+		return errors.New("dataUsageApi.fullRefreshMode must be batch or single-pass")
+	}
+
+	if c.UpdateWorkers < 1 {
+		return errors.New("dataUsageApi.updateWorkers must be at least 1")
+	}
+
+	if c.UpdateQueueSize < 0 {
+		return errors.New("dataUsageApi.updateQueueSize must not be negative")
+	}
+
+	switch c.Transport {
+	case TransportAMQP:
+		if c.AMQPURI == "" {
+			return errors.New("amqp.uri must be set")
+		}
+
+		if c.AMQPExchangeName == "" {
+			return errors.New("amqp.exchange.name must be set")
+		}
+
+		if c.AMQPExchangeType == "" {
+			return errors.New("amqp.exchange.type must be set")
+		}
+	case TransportJetStream:
+		if c.JetStreamStream == "" {
+			return errors.New("transport.jetstream.stream must be set")
+		}
+
+		if c.JetStreamSubjectPrefix == "" {
+			return errors.New("transport.jetstream.subjectPrefix must be set")
+		}
+
+		if c.JetStreamMaxAckPending < 1 {
+			return errors.New("transport.jetstream.maxAckPending must be at least 1")
+		}
+	default:
+		return errors.New("transport.type must be amqp or jetstream")
+	}
+
+	if c.BatchSize < 1 {
+		return errors.New("amqp.batch_size must be at least 1")
+	}
+
+	if c.QMSRetries < 0 {
+		return errors.New("qms.retries must not be negative")
+	}
+
+	if c.QMSBreakerThreshold < 0 {
+		return errors.New("qms.breakerThreshold must not be negative")
 	}
 
-	if c.AMQPExchangeName == "" {
-		return errors.New("amqp.exchange.name must be set")
+	if c.QMSBatchConcurrency < 1 {
+		return errors.New("qms.batchConcurrency must be at least 1")
 	}
 
-	if c.AMQPExchangeType == "" {
-		return errors.New("amqp.exchange.type must be set")
+	if c.QMSForceWriteAfter < 0 {
+		return errors.New("qms.forceWriteAfter must not be negative")
 	}
 
 	return nil
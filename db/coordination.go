@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/cyverse-de/data-usage-api/config"
 	"github.com/cyverse-de/data-usage-api/natsconn"
@@ -118,7 +119,67 @@ func (b *BothDatabases) ICATTx(ctx context.Context) (*ICATDatabase, error) {
 	return b.icattx, nil
 }
 
-func (b *BothDatabases) UpdateUserDataUsage(context context.Context, username string) (*natsconn.UserDataUsage, error) {
+func usageReading(username string, usage *UserUsage, source string) UsageReading {
+	return UsageReading{
+		Username:   username,
+		Total:      usage.Total,
+		HomeBytes:  usage.HomeBytes,
+		TrashBytes: usage.TrashBytes,
+		Source:     source,
+		Breakdown:  &usage.UsageBreakdown,
+	}
+}
+
+// qmsPush returns the values pushed to QMS for the user's usage. The data
+// object count is only included if it's pushed.
+func qmsPush(username string, usage *UserUsage, cfg *config.Config) QMSPush {
+	push := QMSPush{Username: username, Total: usage.Total}
+	if cfg.QMSPushObjectCounts {
+		count := usage.DataObjects
+		push.ObjectCount = &count
+	}
+	return push
+}
+
+// pushIsCurrent returns whether QMS already has the values for the user's
+// usage, from a push recent enough that it doesn't need to be written again. A
+// qms.forceWriteAfter of zero means pushes are never skipped.
+func pushIsCurrent(pushes map[string]QMSPush, username string, usage *UserUsage, cfg *config.Config) bool {
+	push, ok := pushes[username]
+	if !ok || cfg.QMSForceWriteAfter <= 0 {
+		return false
+	}
+	if cfg.QMSPushObjectCounts && (push.ObjectCount == nil || *push.ObjectCount != usage.DataObjects) {
+		return false
+	}
+	return push.Total == usage.Total && time.Since(push.PushedAt) < cfg.QMSForceWriteAfter
+}
+
+// recordPushed records usage readings for the values that were pushed to QMS,
+// and notes the pushes themselves. Readings are only recorded once QMS has the
+// value, so the history never shows a value QMS didn't receive. It runs
+// outside of any transaction, since the pushes have already happened, and only
+// logs failures: the worst outcome is a gap in the history or an extra write
+// next time.
+func (b *BothDatabases) recordPushed(ctx context.Context, readings []UsageReading, pushes []QMSPush) {
+	d := NewDE(b.deconn, b.configuration)
+
+	err := d.AddUsageReadings(ctx, readings)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Error recording usage readings"))
+	}
+
+	err = d.RecordQMSPushes(ctx, pushes)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Error recording QMS pushes"))
+	}
+}
+
+// UpdateUserDataUsage computes the user's usage and pushes it to QMS, along
+// with their data object count if qms.pushObjectCounts is set. Single updates
+// are always written, since they're requested when QMS is missing the value or
+// has a stale one.
+func (b *BothDatabases) UpdateUserDataUsage(context context.Context, username, source string) (*natsconn.UserDataUsage, error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "UpdateUserDataUsage")
 	defer span.End()
 
@@ -139,20 +200,19 @@ func (b *BothDatabases) UpdateUserDataUsage(context context.Context, username st
 		return nil, errors.Wrap(err, "error getting user info")
 	}
 
-	usagenum, err := icatdb.UserCurrentDataUsage(ctx, username)
+	usage, err := icatdb.UserCurrentDataUsage(ctx, username)
 	if err == sql.ErrNoRows {
-		usagenum = 0
+		usage = &UserUsage{Username: username}
 		log.Infof("No usage information was found for user %s. Attempting to add a usage of 0 anyway", username)
 	} else if err != nil {
 		return nil, errors.Wrap(err, "Error getting current data usage")
 	}
 	b.ICATRollback()
+	b.DERollback()
 
-	log.Debugf("username %s; usage value %d", username, usagenum)
-	// if this update shouldn't be added, or should amend a prior reading, do it here or in the method called below
-	// or maybe have an async cleanup process that deduplicates readings
+	log.Debugf("username %s; usage value %d", username, usage.Total)
 
-	res, err := b.nc.UpdateUsageForUser(ctx, b.configuration, username, float64(usagenum))
+	res, err := b.nc.UpdateUsageForUser(ctx, b.configuration, username, float64(usage.Total))
 	if err == sql.ErrNoRows {
 		e := errors.Wrap(err, "No data could be inserted. Perhaps the user doesn't exist in the DE database")
 		log.Error(e)
@@ -163,13 +223,30 @@ func (b *BothDatabases) UpdateUserDataUsage(context context.Context, username st
 		return nil, e
 	}
 
+	if b.configuration.QMSPushObjectCounts {
+		_, err = b.nc.UpdateObjectCountForUser(ctx, b.configuration, username, float64(usage.DataObjects))
+		if err != nil {
+			e := errors.Wrap(err, "Error adding user object count")
+			log.Error(e)
+			return nil, e
+		}
+	}
+
+	b.recordPushed(ctx, []UsageReading{usageReading(userInfo.Username, usage, source)}, []QMSPush{qmsPush(userInfo.Username, usage, b.configuration)})
+
 	res.UserID = userInfo.ID
 	res.Username = userInfo.Username
+	res.UsageBreakdown = &usage.UsageBreakdown
 
 	return res, err
 }
 
-func (b *BothDatabases) UpdateUserDataUsageBatch(context context.Context, start, end string) ([]*natsconn.UserDataUsage, error) {
+// UpdateUserDataUsageBatch computes the usage for every user from start to end
+// and pushes it to QMS. Users whose usage hasn't changed since it was last
+// pushed are skipped, and get no new usage reading, until the push is older
+// than qms.forceWriteAfter. The error is only set if the batch as a whole
+// failed; per-user QMS failures are reported in the results.
+func (b *BothDatabases) UpdateUserDataUsageBatch(context context.Context, start, end string) ([]natsconn.UserUpdateResult, error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "UpdateUserDataUsageBatch")
 	defer span.End()
 
@@ -188,11 +265,63 @@ func (b *BothDatabases) UpdateUserDataUsageBatch(context context.Context, start,
 
 	log.Tracef("usages in batch: %+v", usages)
 
+	return b.pushUsages(ctx, usages)
+}
+
+// UpdateUsersDataUsage is like UpdateUserDataUsageBatch, but for a list of
+// users rather than everyone between two bounds.
+func (b *BothDatabases) UpdateUsersDataUsage(context context.Context, usernames []string) ([]natsconn.UserUpdateResult, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UpdateUsersDataUsage")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	usages, err := icatdb.UsersCurrentDataUsage(ctx, usernames)
+	if err != nil {
+		return nil, err
+	}
+	b.ICATRollback()
+
+	log.Tracef("usages for users: %+v", usages)
+
+	return b.pushUsages(ctx, usages)
+}
+
+// UpdateAllDataUsage computes every user's usage in a single pass over the
+// ICAT and pushes it to QMS in chunks of chunkSize users as the results come
+// in, calling fn with each chunk's results. Like UpdateUserDataUsageBatch,
+// unchanged values are skipped. A chunk that fails as a whole is passed to fn
+// with its error rather than ending the pass; the pass only stops if fn
+// returns an error or reading from the ICAT fails.
+func (b *BothDatabases) UpdateAllDataUsage(context context.Context, chunkSize int, fn func([]natsconn.UserUpdateResult, error) error) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "UpdateAllDataUsage")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	return icatdb.AllCurrentDataUsage(ctx, chunkSize, func(usages map[string]*UserUsage) error {
+		return fn(b.pushUsages(ctx, usages))
+	})
+}
+
+// pushUsages pushes the values that QMS doesn't already have for the users,
+// keyed by unqualified username, and records usage readings for the ones that
+// were pushed.
+func (b *BothDatabases) pushUsages(ctx context.Context, usages map[string]*UserUsage) ([]natsconn.UserUpdateResult, error) {
 	var us []string
-	usagesFixed := make(map[string]float64)
+	usagesFixed := make(map[string]*UserUsage)
 	for usr, usg := range usages { // keys of usages map
-		us = append(us, util.FixUsername(usr, b.configuration))
-		usagesFixed[util.FixUsername(usr, b.configuration)] = float64(usg)
+		fixed := util.FixUsername(usr, b.configuration)
+		us = append(us, fixed)
+		usagesFixed[fixed] = usg
 	}
 
 	dedb, err := b.DETx(ctx)
@@ -210,6 +339,21 @@ func (b *BothDatabases) UpdateUserDataUsageBatch(context context.Context, start,
 		log.Tracef("No users to be ensured in the batch")
 	}
 
+	pushes, err := dedb.LastQMSPushes(ctx, us)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error looking up previous QMS pushes")
+	}
+
+	var skipped []natsconn.UserUpdateResult
+	toPush := make(map[string]float64)
+	for usr, usg := range usagesFixed {
+		if pushIsCurrent(pushes, usr, usg, b.configuration) {
+			skipped = append(skipped, natsconn.UserUpdateResult{Username: usr, Skipped: true})
+			continue
+		}
+		toPush[usr] = float64(usg.Total)
+	}
+
 	err = b.DECommit()
 	if err != nil {
 		e := errors.Wrap(err, "Error committing DE transaction")
@@ -217,10 +361,218 @@ func (b *BothDatabases) UpdateUserDataUsageBatch(context context.Context, start,
 		return nil, e
 	}
 
-	res, err := b.nc.AddUserUpdatesBatch(ctx, b.configuration, usagesFixed)
+	res := b.nc.AddUserUpdatesBatch(ctx, b.configuration, toPush)
+	if b.configuration.QMSPushObjectCounts {
+		b.pushObjectCounts(ctx, res, usagesFixed)
+	}
+
+	var readings []UsageReading
+	var written []QMSPush
+	for _, r := range res {
+		if r.Err != nil {
+			log.Error(errors.Wrapf(r.Err, "Error inserting new usage for %s", r.Username))
+			continue
+		}
+		readings = append(readings, usageReading(r.Username, usagesFixed[r.Username], UsageSourceBatch))
+		written = append(written, qmsPush(r.Username, usagesFixed[r.Username], b.configuration))
+	}
+
+	b.recordPushed(ctx, readings, written)
+
+	return append(res, skipped...), nil
+}
+
+// pushObjectCounts pushes the data object counts of the users whose usage was
+// just pushed successfully. A failed count push fails the user's result, so
+// that the user is retried.
+func (b *BothDatabases) pushObjectCounts(ctx context.Context, res []natsconn.UserUpdateResult, usages map[string]*UserUsage) {
+	counts := make(map[string]float64)
+	for _, r := range res {
+		if r.Err == nil {
+			counts[r.Username] = float64(usages[r.Username].DataObjects)
+		}
+	}
+
+	failed := make(map[string]error)
+	for _, r := range b.nc.AddUserObjectCountsBatch(ctx, b.configuration, counts) {
+		if r.Err != nil {
+			failed[r.Username] = errors.Wrap(r.Err, "Error adding user object count")
+		}
+	}
+
+	for i := range res {
+		if err, ok := failed[res[i].Username]; ok {
+			res[i].Err = err
+		}
+	}
+}
+
+// UserResourceUsage is a user's data usage broken down by root resource.
+type UserResourceUsage struct {
+	Username  string          `json:"username"`
+	Total     int64           `json:"total"`
+	Resources []ResourceUsage `json:"resources"`
+}
+
+func (b *BothDatabases) UserDataUsageByResource(context context.Context, username string) (*UserResourceUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserDataUsageByResource")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	resources, err := icatdb.UserDataUsageByResource(ctx, username)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting data usage by resource")
+	}
+
+	var total int64
+	for _, r := range resources {
+		total += r.Total
+	}
+
+	return &UserResourceUsage{
+		Username:  username,
+		Total:     total,
+		Resources: resources,
+	}, nil
+}
+
+func (b *BothDatabases) UserFolderSizes(context context.Context, username, subpath string, depth int) ([]FolderSize, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserFolderSizes")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	folders, err := icatdb.UserFolderSizes(ctx, username, subpath, depth)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting folder sizes")
+	}
+
+	return folders, nil
+}
+
+// UserTypeUsage is a user's data usage broken down by file extension and by
+// iRODS data type.
+type UserTypeUsage struct {
+	Username   string      `json:"username"`
+	Extensions []TypeUsage `json:"extensions"`
+	DataTypes  []TypeUsage `json:"data_types"`
+}
+
+func (b *BothDatabases) UserDataUsageByType(context context.Context, username string) (*UserTypeUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserDataUsageByType")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	extensions, dataTypes, err := icatdb.UserDataUsageByType(ctx, username)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting data usage by type")
+	}
+
+	return &UserTypeUsage{
+		Username:   username,
+		Extensions: extensions,
+		DataTypes:  dataTypes,
+	}, nil
+}
+
+func (b *BothDatabases) UserLargestDataObjects(context context.Context, username string, limit uint64) ([]DataObject, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserLargestDataObjects")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	objects, err := icatdb.UserLargestDataObjects(ctx, username, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting largest data objects")
+	}
+
+	return objects, nil
+}
+
+// AgeReport is data usage bucketed by how long ago it was last modified. The
+// username is only set for a single user's report.
+type AgeReport struct {
+	Username string      `json:"username,omitempty"`
+	Total    int64       `json:"total"`
+	Buckets  []AgeBucket `json:"buckets"`
+}
+
+func newAgeReport(username string, buckets []AgeBucket) *AgeReport {
+	var total int64
+	for _, bucket := range buckets {
+		total += bucket.Total
+	}
+	return &AgeReport{Username: username, Total: total, Buckets: buckets}
+}
+
+func (b *BothDatabases) UserDataAgeBuckets(context context.Context, username string) (*AgeReport, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserDataAgeBuckets")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	buckets, err := icatdb.UserDataAgeBuckets(ctx, username)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting data age buckets")
+	}
+
+	return newAgeReport(username, buckets), nil
+}
+
+func (b *BothDatabases) ZoneDataAgeBuckets(context context.Context) (*AgeReport, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "ZoneDataAgeBuckets")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	buckets, err := icatdb.ZoneDataAgeBuckets(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting zone-wide data age buckets")
+	}
+
+	return newAgeReport("", buckets), nil
+}
+
+func (b *BothDatabases) CompareAttribution(context context.Context, limit uint64) ([]AttributionDifference, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "CompareAttribution")
+	defer span.End()
+
+	icatdb, err := b.ICATTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating ICAT transaction")
+	}
+	defer b.ICATRollback()
+
+	differences, err := icatdb.CompareAttribution(ctx, limit)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error inserting new usage")
+		return nil, errors.Wrap(err, "Error comparing attribution modes")
 	}
 
-	return res, nil
+	return differences, nil
 }
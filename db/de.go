@@ -2,10 +2,15 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/Masterminds/squirrel"
 	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/data-usage-api/natsconn"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
 )
@@ -15,6 +20,71 @@ type UserInfo struct {
 	Username string `db:"username" json:"username"`
 }
 
+// The sources a usage reading can come from.
+const (
+	UsageSourceBatch  = "batch"
+	UsageSourceSingle = "single"
+	UsageSourceManual = "manual"
+)
+
+// UsageReading is a single computed usage value for a user, as recorded in the
+// usage history table. The full breakdown is stored with each reading, but
+// only returned by LatestUsageReading.
+type UsageReading struct {
+	Username   string                   `db:"username" json:"-"`
+	Total      int64                    `db:"total" json:"total"`
+	HomeBytes  int64                    `db:"home_bytes" json:"home_bytes"`
+	TrashBytes int64                    `db:"trash_bytes" json:"trash_bytes"`
+	Source     string                   `db:"source" json:"source"`
+	RecordedAt time.Time                `db:"recorded_at" json:"recorded_at"`
+	Breakdown  *natsconn.UsageBreakdown `db:"-" json:"-"`
+}
+
+// The kinds of recalculation job. Full jobs cover every user, while
+// incremental jobs only cover users whose data changed since the last
+// successful job.
+const (
+	UsageJobFull        = "full"
+	UsageJobIncremental = "incremental"
+)
+
+// UsageJob tracks the progress of a recalculation run.
+type UsageJob struct {
+	ID               string    `db:"id" json:"id"`
+	Kind             string    `db:"kind" json:"kind"`
+	CreatedAt        time.Time `db:"created_at" json:"created_at"`
+	BatchesTotal     int       `db:"batches_total" json:"batches_total"`
+	BatchesPublished int       `db:"batches_published" json:"batches_published"`
+	BatchesCompleted int       `db:"batches_completed" json:"batches_completed"`
+	BatchesFailed    int       `db:"batches_failed" json:"batches_failed"`
+	PublishingDone   bool      `db:"publishing_done" json:"publishing_done"`
+	UsersWritten     int       `db:"users_written" json:"users_written"`
+	UsersSkipped     int       `db:"users_skipped" json:"users_skipped"`
+	BatchesInFlight  int       `db:"-" json:"batches_in_flight"`
+	Status           string    `db:"-" json:"status"`
+}
+
+// DeadLetter is an update message that failed for good, along with the reason
+// it failed.
+type DeadLetter struct {
+	ID         string     `db:"id" json:"id"`
+	Queue      string     `db:"queue" json:"queue"`
+	RoutingKey string     `db:"routing_key" json:"routing_key"`
+	Body       []byte     `db:"body" json:"body"`
+	Reason     string     `db:"reason" json:"reason"`
+	FailedAt   time.Time  `db:"failed_at" json:"failed_at"`
+	ReplayedAt *time.Time `db:"replayed_at" json:"replayed_at"`
+}
+
+// QMSPush is the last usage value pushed to QMS for a user. ObjectCount is
+// only set if the data object count was pushed along with it.
+type QMSPush struct {
+	Username    string    `db:"username"`
+	Total       int64     `db:"total"`
+	ObjectCount *int64    `db:"object_count"`
+	PushedAt    time.Time `db:"pushed_at"`
+}
+
 type DEDatabase struct {
 	db            DatabaseAccessor
 	configuration *config.Config
@@ -89,3 +159,519 @@ func (d *DEDatabase) GetUserInfo(context context.Context, username string) (*Use
 	retval := uis[0]
 	return &retval, nil
 }
+
+// AddUsageReadings records computed usage values in the usage history table.
+// Usernames should already be domain-qualified and exist in the users table.
+func (d *DEDatabase) AddUsageReadings(context context.Context, readings []UsageReading) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "AddUsageReadings")
+	defer span.End()
+
+	if len(readings) == 0 {
+		return nil
+	}
+
+	userIDQuery := fmt.Sprintf("(SELECT id FROM %s WHERE username = ?)", d.Table("users", "u"))
+
+	query := psql.Insert(d.Table("data_usage_history", "h")).
+		Columns("user_id", "total", "home_bytes", "trash_bytes", "source", "breakdown")
+	for _, r := range readings {
+		var breakdown interface{}
+		if r.Breakdown != nil {
+			b, err := json.Marshal(r.Breakdown)
+			if err != nil {
+				return errors.Wrap(err, "Error encoding usage breakdown")
+			}
+			breakdown = string(b)
+		}
+		query = query.Values(squirrel.Expr(userIDQuery, r.Username), r.Total, r.HomeBytes, r.TrashBytes, r.Source, breakdown)
+	}
+
+	qs, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting usage history insert SQL")
+	}
+
+	log.Tracef("AddUsageReadings SQL: %s, %+v", qs, args)
+
+	_, err = d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error inserting usage readings")
+	}
+	return nil
+}
+
+// ValidHistoryInterval returns whether the interval can be used to group usage
+// history readings.
+func ValidHistoryInterval(interval string) bool {
+	switch interval {
+	case "hour", "day", "week", "month", "year":
+		return true
+	}
+	return false
+}
+
+// LatestUsageReading returns the user's most recent usage reading, along with
+// its breakdown if one was stored. Returns sql.ErrNoRows if the user has none.
+func (d *DEDatabase) LatestUsageReading(context context.Context, username string) (*UsageReading, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "LatestUsageReading")
+	defer span.End()
+
+	qs, args, err := psql.Select("u.username", "h.total", "h.home_bytes", "h.trash_bytes", "h.source", "h.recorded_at", "h.breakdown").
+		From(d.Table("data_usage_history", "h")).
+		Join(fmt.Sprintf("%s ON h.user_id = u.id", d.Table("users", "u"))).
+		Where(squirrel.Eq{"u.username": username}).
+		OrderBy("h.recorded_at DESC").
+		Limit(1).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting latest usage reading SQL")
+	}
+
+	var row struct {
+		UsageReading
+		Breakdown sql.NullString `db:"breakdown"`
+	}
+	err = d.db.GetContext(ctx, &row, qs, args...)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Error fetching latest usage reading")
+	}
+
+	rv := row.UsageReading
+	if row.Breakdown.Valid {
+		rv.Breakdown = &natsconn.UsageBreakdown{}
+		if err = json.Unmarshal([]byte(row.Breakdown.String), rv.Breakdown); err != nil {
+			return nil, errors.Wrap(err, "Error decoding usage breakdown")
+		}
+	}
+
+	return &rv, nil
+}
+
+// UsageHistory returns the recorded usage readings for a user from from up to,
+// but not including, to. If interval is set, only the last reading in each interval (as accepted
+// by PostgreSQL's date_trunc) is returned.
+func (d *DEDatabase) UsageHistory(context context.Context, username string, from, to time.Time, interval string) ([]UsageReading, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UsageHistory")
+	defer span.End()
+
+	query := psql.Select("u.username", "h.total", "h.home_bytes", "h.trash_bytes", "h.source", "h.recorded_at").
+		From(d.Table("data_usage_history", "h")).
+		Join(fmt.Sprintf("%s ON u.id = h.user_id", d.Table("users", "u"))).
+		Where("u.username = ?", username).
+		Where("h.recorded_at >= ? AND h.recorded_at < ?", from, to)
+
+	if interval != "" {
+		if !ValidHistoryInterval(interval) {
+			return nil, errors.Errorf("invalid history interval: %s", interval)
+		}
+		// The interval is interpolated rather than passed as an argument so that
+		// the DISTINCT ON and ORDER BY expressions are identical.
+		bucket := fmt.Sprintf("date_trunc('%s', h.recorded_at)", interval)
+		query = query.
+			Options(fmt.Sprintf("DISTINCT ON (%s)", bucket)).
+			OrderBy(bucket, "h.recorded_at DESC")
+	} else {
+		query = query.OrderBy("h.recorded_at")
+	}
+
+	qs, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting usage history SQL")
+	}
+
+	log.Tracef("UsageHistory SQL: %s, %+v", qs, args)
+
+	rv := make([]UsageReading, 0)
+	err = d.db.SelectContext(ctx, &rv, qs, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching usage history")
+	}
+
+	return rv, nil
+}
+
+// CreateUsageJob records the start of a new recalculation job of the given
+// kind and returns its ID.
+func (d *DEDatabase) CreateUsageJob(context context.Context, kind string, batchesTotal int) (string, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "CreateUsageJob")
+	defer span.End()
+
+	qs, args, err := psql.Insert(d.Table("data_usage_jobs", "j")).
+		Columns("kind", "batches_total").
+		Values(kind, batchesTotal).
+		Suffix("RETURNING id").
+		ToSql()
+	if err != nil {
+		return "", errors.Wrap(err, "Error formatting job insert SQL")
+	}
+
+	var id string
+	err = d.db.GetContext(ctx, &id, qs, args...)
+	if err != nil {
+		return "", errors.Wrap(err, "Error inserting job")
+	}
+	return id, nil
+}
+
+// FinishPublishingUsageJob records how many of a job's batches were
+// successfully published.
+func (d *DEDatabase) FinishPublishingUsageJob(context context.Context, id string, published int) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "FinishPublishingUsageJob")
+	defer span.End()
+
+	qs, args, err := psql.Update(d.Table("data_usage_jobs", "j")).
+		Set("batches_published", published).
+		Set("publishing_done", true).
+		Where("id = ?", id).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting job update SQL")
+	}
+
+	_, err = d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error updating job")
+	}
+	return nil
+}
+
+// AddUsageJobBatch records that a job that doesn't know its batches up front
+// has started another one, counting it as published.
+func (d *DEDatabase) AddUsageJobBatch(context context.Context, id string) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "AddUsageJobBatch")
+	defer span.End()
+
+	qs, args, err := psql.Update(d.Table("data_usage_jobs", "j")).
+		Set("batches_total", squirrel.Expr("batches_total + 1")).
+		Set("batches_published", squirrel.Expr("batches_published + 1")).
+		Where("id = ?", id).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting job update SQL")
+	}
+
+	_, err = d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error updating job")
+	}
+	return nil
+}
+
+// RecordUsageJobBatch records that one of a job's batches has finished, either
+// successfully or for good, along with how many of its users were written to
+// QMS and how many were skipped as unchanged.
+func (d *DEDatabase) RecordUsageJobBatch(context context.Context, id string, succeeded bool, written, skipped int) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "RecordUsageJobBatch")
+	defer span.End()
+
+	column := "batches_failed"
+	if succeeded {
+		column = "batches_completed"
+	}
+
+	qs, args, err := psql.Update(d.Table("data_usage_jobs", "j")).
+		Set(column, squirrel.Expr(column+" + 1")).
+		Set("users_written", squirrel.Expr("users_written + ?", written)).
+		Set("users_skipped", squirrel.Expr("users_skipped + ?", skipped)).
+		Where("id = ?", id).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting job update SQL")
+	}
+
+	_, err = d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error updating job")
+	}
+	return nil
+}
+
+// HeartbeatUsageJob records that a job running in this process is still
+// alive. Only jobs that run in-process have heartbeats.
+func (d *DEDatabase) HeartbeatUsageJob(context context.Context, id string) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "HeartbeatUsageJob")
+	defer span.End()
+
+	qs, args, err := psql.Update(d.Table("data_usage_jobs", "j")).
+		Set("heartbeat_at", squirrel.Expr("now()")).
+		Where("id = ?", id).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting job heartbeat SQL")
+	}
+
+	_, err = d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error recording job heartbeat")
+	}
+	return nil
+}
+
+// FailStaleUsageJobs marks the unfinished batches of in-process jobs that
+// haven't had a heartbeat in maxAge as failed, and returns how many jobs were
+// affected. A job that was still adding batches gets one more failed batch for
+// the part of it that never ran.
+func (d *DEDatabase) FailStaleUsageJobs(context context.Context, maxAge time.Duration) (int64, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "FailStaleUsageJobs")
+	defer span.End()
+
+	qs, args, err := psql.Update(d.Table("data_usage_jobs", "j")).
+		Set("batches_total", squirrel.Expr("batches_total + CASE WHEN publishing_done THEN 0 ELSE 1 END")).
+		Set("batches_published", squirrel.Expr("batches_published + CASE WHEN publishing_done THEN 0 ELSE 1 END")).
+		Set("batches_failed", squirrel.Expr("batches_published - batches_completed + CASE WHEN publishing_done THEN 0 ELSE 1 END")).
+		Set("publishing_done", true).
+		Where("heartbeat_at < now() - ? * interval '1 second'", maxAge.Seconds()).
+		Where("(NOT publishing_done OR batches_completed + batches_failed < batches_published)").
+		ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error formatting stale job update SQL")
+	}
+
+	res, err := d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error failing stale jobs")
+	}
+	return res.RowsAffected()
+}
+
+// GetUsageJob returns the progress of a recalculation job. Returns
+// sql.ErrNoRows if the job doesn't exist.
+func (d *DEDatabase) GetUsageJob(context context.Context, id string) (*UsageJob, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "GetUsageJob")
+	defer span.End()
+
+	qs, args, err := psql.Select("id", "kind", "created_at", "batches_total", "batches_published", "batches_completed", "batches_failed", "publishing_done", "users_written", "users_skipped").
+		From(d.Table("data_usage_jobs", "j")).
+		// Compare as text so that malformed IDs are simply not found.
+		Where("id::text = ?", id).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting job lookup SQL")
+	}
+
+	var job UsageJob
+	err = d.db.GetContext(ctx, &job, qs, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	job.BatchesInFlight = max(job.BatchesPublished-job.BatchesCompleted-job.BatchesFailed, 0)
+	switch {
+	case !job.PublishingDone:
+		job.Status = "publishing"
+	case job.BatchesInFlight > 0:
+		job.Status = "running"
+	case job.BatchesFailed > 0:
+		job.Status = "failed"
+	default:
+		job.Status = "completed"
+	}
+
+	return &job, nil
+}
+
+// LatestUsageJobTime returns when the most recent recalculation job of the
+// given kind was created. The second return value is false if there haven't
+// been any.
+func (d *DEDatabase) LatestUsageJobTime(context context.Context, kind string) (time.Time, bool, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "LatestUsageJobTime")
+	defer span.End()
+
+	qs, args, err := psql.Select("max(created_at)").
+		From(d.Table("data_usage_jobs", "j")).
+		Where("kind = ?", kind).
+		ToSql()
+	if err != nil {
+		return time.Time{}, false, errors.Wrap(err, "Error formatting latest job SQL")
+	}
+
+	return d.jobTime(ctx, qs, args)
+}
+
+// LastSuccessfulUsageJobTime returns when the most recent job of any kind that
+// published and completed all of its batches was created. The second return
+// value is false if no job has succeeded yet.
+func (d *DEDatabase) LastSuccessfulUsageJobTime(context context.Context) (time.Time, bool, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "LastSuccessfulUsageJobTime")
+	defer span.End()
+
+	qs, args, err := psql.Select("max(created_at)").
+		From(d.Table("data_usage_jobs", "j")).
+		Where("publishing_done").
+		Where("batches_published = batches_total").
+		Where("batches_completed = batches_published").
+		Where("batches_failed = 0").
+		ToSql()
+	if err != nil {
+		return time.Time{}, false, errors.Wrap(err, "Error formatting last successful job SQL")
+	}
+
+	return d.jobTime(ctx, qs, args)
+}
+
+func (d *DEDatabase) jobTime(ctx context.Context, qs string, args []interface{}) (time.Time, bool, error) {
+	var latest sql.NullTime
+	err := d.db.GetContext(ctx, &latest, qs, args...)
+	if err != nil {
+		return time.Time{}, false, errors.Wrap(err, "Error fetching job time")
+	}
+
+	return latest.Time, latest.Valid, nil
+}
+
+// LastQMSPushes returns the last usage value pushed to QMS for each of the
+// users, keyed by username. Users that have never been pushed are left out.
+func (d *DEDatabase) LastQMSPushes(context context.Context, usernames []string) (map[string]QMSPush, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "LastQMSPushes")
+	defer span.End()
+
+	rv := make(map[string]QMSPush)
+	if len(usernames) == 0 {
+		return rv, nil
+	}
+
+	qs, args, err := psql.Select("u.username", "p.total", "p.object_count", "p.pushed_at").
+		From(d.Table("data_usage_qms_pushes", "p")).
+		Join(fmt.Sprintf("%s ON p.user_id = u.id", d.Table("users", "u"))).
+		Where(squirrel.Eq{"u.username": usernames}).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting QMS push lookup SQL")
+	}
+
+	var pushes []QMSPush
+	err = d.db.SelectContext(ctx, &pushes, qs, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching QMS pushes")
+	}
+
+	for _, p := range pushes {
+		rv[p.Username] = p
+	}
+	return rv, nil
+}
+
+// RecordQMSPushes records the usage values that were just pushed to QMS.
+// Usernames should already be domain-qualified and exist in the users table.
+func (d *DEDatabase) RecordQMSPushes(context context.Context, pushes []QMSPush) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "RecordQMSPushes")
+	defer span.End()
+
+	if len(pushes) == 0 {
+		return nil
+	}
+
+	userIDQuery := fmt.Sprintf("(SELECT id FROM %s WHERE username = ?)", d.Table("users", "u"))
+
+	query := psql.Insert(d.Table("data_usage_qms_pushes", "p")).
+		Columns("user_id", "total", "object_count").
+		Suffix("ON CONFLICT (user_id) DO UPDATE SET total = EXCLUDED.total, object_count = EXCLUDED.object_count, pushed_at = now()")
+	for _, p := range pushes {
+		query = query.Values(squirrel.Expr(userIDQuery, p.Username), p.Total, p.ObjectCount)
+	}
+
+	qs, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting QMS push insert SQL")
+	}
+
+	_, err = d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error recording QMS pushes")
+	}
+	return nil
+}
+
+// AddDeadLetter records a message that failed for good.
+func (d *DEDatabase) AddDeadLetter(context context.Context, dl *DeadLetter) (string, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "AddDeadLetter")
+	defer span.End()
+
+	qs, args, err := psql.Insert(d.Table("data_usage_dead_letters", "dl")).
+		Columns("queue", "routing_key", "body", "reason").
+		Values(dl.Queue, dl.RoutingKey, dl.Body, dl.Reason).
+		Suffix("RETURNING id").
+		ToSql()
+	if err != nil {
+		return "", errors.Wrap(err, "Error formatting dead letter insert SQL")
+	}
+
+	var id string
+	err = d.db.GetContext(ctx, &id, qs, args...)
+	if err != nil {
+		return "", errors.Wrap(err, "Error inserting dead letter")
+	}
+	return id, nil
+}
+
+func (d *DEDatabase) deadLettersQuery() squirrel.SelectBuilder {
+	return psql.Select("id", "queue", "routing_key", "body", "reason", "failed_at", "replayed_at").
+		From(d.Table("data_usage_dead_letters", "dl"))
+}
+
+// ListDeadLetters returns the recorded dead letters, oldest first. Replayed
+// messages are only included if includeReplayed is set.
+func (d *DEDatabase) ListDeadLetters(context context.Context, includeReplayed bool) ([]DeadLetter, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "ListDeadLetters")
+	defer span.End()
+
+	query := d.deadLettersQuery().OrderBy("failed_at")
+	if !includeReplayed {
+		query = query.Where("replayed_at IS NULL")
+	}
+
+	qs, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting dead letter lookup SQL")
+	}
+
+	rv := make([]DeadLetter, 0)
+	err = d.db.SelectContext(ctx, &rv, qs, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching dead letters")
+	}
+	return rv, nil
+}
+
+// GetDeadLetter returns a single dead letter. Returns sql.ErrNoRows if it
+// doesn't exist.
+func (d *DEDatabase) GetDeadLetter(context context.Context, id string) (*DeadLetter, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "GetDeadLetter")
+	defer span.End()
+
+	qs, args, err := d.deadLettersQuery().
+		Where("id::text = ?", id).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting dead letter lookup SQL")
+	}
+
+	var dl DeadLetter
+	err = d.db.GetContext(ctx, &dl, qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// MarkDeadLetterReplayed records that a dead letter has been published again.
+func (d *DEDatabase) MarkDeadLetterReplayed(context context.Context, id string) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "MarkDeadLetterReplayed")
+	defer span.End()
+
+	qs, args, err := psql.Update(d.Table("data_usage_dead_letters", "dl")).
+		Set("replayed_at", squirrel.Expr("now()")).
+		Where("id = ?", id).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting dead letter update SQL")
+	}
+
+	_, err = d.db.ExecContext(ctx, qs, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error updating dead letter")
+	}
+	return nil
+}
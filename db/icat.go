@@ -4,11 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/data-usage-api/natsconn"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"github.com/samber/lo"
 	"go.opentelemetry.io/otel"
 )
 
@@ -25,6 +30,11 @@ func (i *ICATDatabase) UnqualifiedUsername(username string) string {
 	return strings.TrimSuffix(username, "@"+i.configuration.UserSuffix)
 }
 
+// UserHomePath returns the path to the user's home collection.
+func (i *ICATDatabase) UserHomePath(username string) string {
+	return fmt.Sprintf("/%s/home/%s", i.configuration.Zone, i.UnqualifiedUsername(username))
+}
+
 func (i *ICATDatabase) createStorageRootMapping(context context.Context) error {
 	ctx, span := otel.Tracer(otelName).Start(context, "createStorageRootMapping")
 	defer span.End()
@@ -62,7 +72,7 @@ func (i *ICATDatabase) createUserCollsTable(context context.Context) (string, er
 	defer span.End()
 
 	q := `
-CREATE TEMPORARY TABLE user_colls (user_name text, coll_id bigint) ON COMMIT DROP`
+CREATE TEMPORARY TABLE user_colls (user_name text, coll_id bigint, area text) ON COMMIT DROP`
 	_, err := i.db.ExecContext(ctx, q)
 	if err != nil {
 		return "", errors.Wrap(err, "Error creating empty user_colls table")
@@ -76,12 +86,17 @@ func (i *ICATDatabase) populateSpecificUserColls(context context.Context, userna
 	defer span.End()
 
 	// subfolders of /trash/home need to come first or their contents all get assigned to the subfolder name
-	q := fmt.Sprintf(`INSERT INTO %s (user_name, coll_id)
+	q := fmt.Sprintf(`INSERT INTO %s (user_name, coll_id, area)
 SELECT CASE WHEN coll_name LIKE '/' || $1 || '/home/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/home/([^/]+).*', E'\\1')
 	    WHEN coll_name LIKE '/' || $1 || '/trash/home/de-irods/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/de-irods/([^/]+).*', E'\\1')
 	    WHEN coll_name LIKE '/' || $1 || '/trash/home/ipcservices/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/ipcservices/([^/]+).*', E'\\1')
             WHEN coll_name LIKE '/' || $1 || '/trash/home/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/([^/]+).*', E'\\1')
-       END, coll_id
+       END, coll_id,
+       CASE WHEN coll_name LIKE '/' || $1 || '/home/%%' THEN 'home'
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/de-irods/%%' THEN 'trash/home/de-irods'
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/ipcservices/%%' THEN 'trash/home/ipcservices'
+            WHEN coll_name LIKE '/' || $1 || '/trash/home/%%' THEN 'trash/home'
+       END
     FROM r_coll_main
    WHERE coll_name LIKE '/' || $1 || '/home/' || $2 || '/%%'
       OR coll_name =    '/' || $1 || '/home/' || $2
@@ -106,12 +121,17 @@ func (i *ICATDatabase) populateBatchUserColls(context context.Context, start, en
 	ctx, span := otel.Tracer(otelName).Start(context, "populateBatchUserColls")
 	defer span.End()
 
-	q := fmt.Sprintf(`INSERT INTO %s (user_name, coll_id)
+	q := fmt.Sprintf(`INSERT INTO %s (user_name, coll_id, area)
 SELECT CASE WHEN coll_name LIKE '/' || $1 || '/home/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/home/([^/]+).*', E'\\1')
 	    WHEN coll_name LIKE '/' || $1 || '/trash/home/de-irods/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/de-irods/([^/]+).*', E'\\1')
 	    WHEN coll_name LIKE '/' || $1 || '/trash/home/ipcservices/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/ipcservices/([^/]+).*', E'\\1')
             WHEN coll_name LIKE '/' || $1 || '/trash/home/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/([^/]+).*', E'\\1')
-       END, coll_id
+       END, coll_id,
+       CASE WHEN coll_name LIKE '/' || $1 || '/home/%%' THEN 'home'
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/de-irods/%%' THEN 'trash/home/de-irods'
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/ipcservices/%%' THEN 'trash/home/ipcservices'
+            WHEN coll_name LIKE '/' || $1 || '/trash/home/%%' THEN 'trash/home'
+       END
     FROM r_coll_main
    WHERE coll_name BETWEEN '/' || $1 || '/home/' || $2 AND '/' || $1 || '/home/' || $3
       OR coll_name LIKE    '/' || $1 || '/home/' || $3 || '/%%'
@@ -132,6 +152,85 @@ SELECT CASE WHEN coll_name LIKE '/' || $1 || '/home/%%' THEN REGEXP_REPLACE(coll
 	return nil
 }
 
+// populateAllUserColls fills the table with every collection in the home and
+// trash areas of the zone.
+func (i *ICATDatabase) populateAllUserColls(context context.Context, table string) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "populateAllUserColls")
+	defer span.End()
+
+	q := fmt.Sprintf(`INSERT INTO %s (user_name, coll_id, area)
+SELECT CASE WHEN coll_name LIKE '/' || $1 || '/home/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/home/([^/]+).*', E'\\1')
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/de-irods/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/de-irods/([^/]+).*', E'\\1')
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/ipcservices/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/ipcservices/([^/]+).*', E'\\1')
+            WHEN coll_name LIKE '/' || $1 || '/trash/home/%%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/([^/]+).*', E'\\1')
+       END, coll_id,
+       CASE WHEN coll_name LIKE '/' || $1 || '/home/%%' THEN 'home'
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/de-irods/%%' THEN 'trash/home/de-irods'
+	    WHEN coll_name LIKE '/' || $1 || '/trash/home/ipcservices/%%' THEN 'trash/home/ipcservices'
+            WHEN coll_name LIKE '/' || $1 || '/trash/home/%%' THEN 'trash/home'
+       END
+    FROM r_coll_main
+   WHERE coll_name LIKE '/' || $1 || '/home/%%'
+      OR coll_name LIKE '/' || $1 || '/trash/home/%%'
+`, table)
+
+	log.Tracef("populateAllUserColls SQL: %s, [%s]", q, i.configuration.Zone)
+
+	_, err := i.db.ExecContext(ctx, q, i.configuration.Zone)
+	if err != nil {
+		return errors.Wrap(err, "Error filling user_colls table for the zone")
+	}
+	return nil
+}
+
+// sharedOwnersQuery selects the collections under /<zone>/home/shared along
+// with the user they're charged to: the collection's recorded owner if they
+// still own it, otherwise the first user with own permission on it. The zone
+// is the first argument.
+const sharedOwnersQuery = `
+SELECT o.user_name, c.coll_id
+  FROM r_coll_main AS c
+  CROSS JOIN LATERAL (
+    SELECT u.user_name
+      FROM r_objt_access AS a
+      JOIN r_user_main AS u ON a.user_id = u.user_id
+      JOIN r_tokn_main AS t ON a.access_type_id = t.token_id
+     WHERE a.object_id = c.coll_id
+       AND t.token_namespace = 'access_type'
+       AND t.token_name = 'own'
+       AND u.user_type_name = 'rodsuser'
+     ORDER BY u.user_name = c.coll_owner_name DESC, u.user_name
+     LIMIT 1
+  ) AS o
+ WHERE c.coll_name LIKE '/' || $1 || '/home/shared/%'`
+
+// populateSharedUserColls adds the shared collections to the table, in the
+// 'shared' area, if shared data is charged to its owner. The owner filter, if
+// any, restricts which owners are included and may use arguments from $2 on.
+func (i *ICATDatabase) populateSharedUserColls(context context.Context, table, ownerFilter string, args ...interface{}) error {
+	if i.configuration.SharedAttribution != config.SharedAttributionOwner {
+		return nil
+	}
+
+	ctx, span := otel.Tracer(otelName).Start(context, "populateSharedUserColls")
+	defer span.End()
+
+	q := fmt.Sprintf("INSERT INTO %s (user_name, coll_id, area)\nSELECT s.user_name, s.coll_id, 'shared' FROM (%s) AS s", table, sharedOwnersQuery)
+	if ownerFilter != "" {
+		q = fmt.Sprintf("%s WHERE %s", q, ownerFilter)
+	}
+
+	args = append([]interface{}{i.configuration.Zone}, args...)
+
+	log.Tracef("populateSharedUserColls SQL: %s, %+v", q, args)
+
+	_, err := i.db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error filling user_colls table with shared collections")
+	}
+	return nil
+}
+
 func (i *ICATDatabase) createSpecificUserColls(context context.Context, username string) (string, error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "createSpecificUserColls")
 	defer span.End()
@@ -142,11 +241,21 @@ func (i *ICATDatabase) createSpecificUserColls(context context.Context, username
 		return "", err
 	}
 
+	// Owner attribution doesn't go through the user collections.
+	if i.ownerAttribution() {
+		return t, nil
+	}
+
 	err = i.populateSpecificUserColls(ctx, u, t)
 	if err != nil {
 		return "", err
 	}
 
+	err = i.populateSharedUserColls(ctx, t, "s.user_name = $2", u)
+	if err != nil {
+		return "", err
+	}
+
 	return t, nil
 }
 
@@ -161,11 +270,21 @@ func (i *ICATDatabase) createBatchUserColls(context context.Context, start, end
 		return "", err
 	}
 
+	// Owner attribution doesn't go through the user collections.
+	if i.ownerAttribution() {
+		return t, nil
+	}
+
 	err = i.populateBatchUserColls(ctx, s, e, t)
 	if err != nil {
 		return "", err
 	}
 
+	err = i.populateSharedUserColls(ctx, t, "s.user_name BETWEEN $2 AND $3", s, e)
+	if err != nil {
+		return "", err
+	}
+
 	return t, nil
 }
 
@@ -177,37 +296,276 @@ func (i *ICATDatabase) resourcesSubselect() (string, []interface{}, error) {
 		ToSql()
 }
 
-func (i *ICATDatabase) baseUsageQuery(userCollsTable, resourceQuery string, resourceArgs []interface{}) squirrel.SelectBuilder {
+// staleFilter matches the replicas of the data objects aliased as d that iRODS
+// has marked stale. Replicas in any other state, including intermediate and
+// locked ones, hold the data object's current contents.
+const staleFilter = "d.data_is_dirty = 0"
+
+// chargedFilter matches the replicas of the data objects aliased as d that are
+// charged to their user under the configured replica accounting. Physical
+// accounting charges every replica, as usage always has been, while logical
+// accounting charges only the first replica that isn't stale. The replica join
+// must be in the query.
+func (i *ICATDatabase) chargedFilter() string {
+	if i.configuration.SizeAccounting == config.SizeLogical {
+		return "d.data_is_dirty <> 0 AND rep.first_replica"
+	}
+	return "true"
+}
+
+// usageColumns selects the charged size of the data objects aliased as d,
+// along with its breakdown by the area column of the collections aliased as c
+// and by replica accounting, along with how many data objects and collections
+// it's made up of. Only collections directly holding a charged replica are
+// counted. The logical and physical figures are reported whichever accounting
+// is configured, with stale replicas counted in the physical figure and
+// reported separately. The replica join must be in the query.
+func (i *ICATDatabase) usageColumns() squirrel.SelectBuilder {
+	charged := i.chargedFilter()
+
+	sum := func(filter, alias string) string {
+		return fmt.Sprintf("COALESCE(SUM(d.data_size) FILTER (WHERE %s),0) AS %s", filter, alias)
+	}
+
 	return psql.Select().
-		Column("COALESCE(SUM(d.data_size),0) AS file_volume").
+		Column(sum(charged, "file_volume")).
+		Column(sum(charged+" AND c.area = 'home'", "home_bytes")).
+		Column(sum(charged+" AND c.area LIKE 'trash/%'", "trash_bytes")).
+		Column(sum(charged+" AND c.area = 'shared'", "shared_bytes")).
+		Column(sum(charged+" AND c.area = 'trash/home'", "trash_home_bytes")).
+		Column(sum(charged+" AND c.area = 'trash/home/de-irods'", "trash_de_irods_bytes")).
+		Column(sum(charged+" AND c.area = 'trash/home/ipcservices'", "trash_ipcservices_bytes")).
+		Column(sum("d.data_is_dirty <> 0 AND rep.first_replica", "logical_bytes")).
+		Column("COALESCE(SUM(d.data_size),0) AS physical_bytes").
+		Column(sum(staleFilter, "stale_bytes")).
+		Column(fmt.Sprintf("COUNT(DISTINCT d.data_id) FILTER (WHERE %s) AS data_object_count", charged)).
+		Column(fmt.Sprintf("COUNT(DISTINCT c.coll_id) FILTER (WHERE d.data_id IS NOT NULL AND %s) AS collection_count", charged))
+}
+
+// replicaJoin flags whether each data object row aliased as d is the first
+// replica of its data object under the configured root resources that isn't
+// stale.
+func replicaJoin(resourceQuery string) string {
+	return fmt.Sprintf(`LATERAL (SELECT NOT EXISTS (
+    SELECT 1 FROM r_data_main AS o
+     WHERE o.data_id = d.data_id
+       AND o.data_repl_num < d.data_repl_num
+       AND o.data_is_dirty <> 0
+       AND o.resc_id = ANY(ARRAY(%s))) AS first_replica) AS rep ON true`, resourceQuery)
+}
+
+// ownerAttribution returns whether data is attributed to its owner rather than
+// by where it lives.
+func (i *ICATDatabase) ownerAttribution() bool {
+	return i.configuration.Attribution == config.AttributionOwner
+}
+
+// ownerIndexQuery checks for a valid index on r_data_main whose leading
+// columns are data_owner_name and data_owner_zone.
+const ownerIndexQuery = `
+SELECT EXISTS (
+    SELECT 1
+      FROM pg_index x
+      JOIN pg_class t ON t.oid = x.indrelid
+      JOIN pg_attribute n ON n.attrelid = t.oid AND n.attnum = x.indkey[0]
+      JOIN pg_attribute z ON z.attrelid = t.oid AND z.attnum = x.indkey[1]
+     WHERE t.relname = 'r_data_main'
+       AND pg_table_is_visible(t.oid)
+       AND n.attname = 'data_owner_name'
+       AND z.attname = 'data_owner_zone'
+       AND x.indisvalid)`
+
+// CheckOwnerIndex returns an error if owner attribution is configured but the
+// ICAT has no index on r_data_main (data_owner_name, data_owner_zone). iRODS
+// doesn't create one, and without it every owner-attributed lookup scans all
+// of r_data_main.
+func (i *ICATDatabase) CheckOwnerIndex(context context.Context) error {
+	if !i.ownerAttribution() {
+		return nil
+	}
+
+	var found bool
+	if err := i.db.GetContext(context, &found, ownerIndexQuery); err != nil {
+		return errors.Wrap(err, "failed checking for the data owner index")
+	}
+	if !found {
+		return errors.New("icat.attribution is owner, but r_data_main has no index on (data_owner_name, data_owner_zone); see the README")
+	}
+	return nil
+}
+
+// baseUsageQuery computes the usage of every rodsuser, grouped by user, using
+// the configured attribution mode. The user collections table is only used
+// for path-based attribution.
+func (i *ICATDatabase) baseUsageQuery(userCollsTable, resourceQuery string, resourceArgs []interface{}) squirrel.SelectBuilder {
+	if i.ownerAttribution() {
+		return i.ownerUsageQuery(resourceQuery, resourceArgs)
+	}
+	return i.pathUsageQuery(userCollsTable, resourceQuery, resourceArgs)
+}
+
+// pathUsageQuery attributes data objects to users by the user collections
+// their collections were mapped to.
+func (i *ICATDatabase) pathUsageQuery(userCollsTable, resourceQuery string, resourceArgs []interface{}) squirrel.SelectBuilder {
+	return i.usageColumns().
 		From("r_user_main AS u").
 		LeftJoin(fmt.Sprintf("%s AS c ON c.user_name = u.user_name", userCollsTable)).
 		LeftJoin("r_data_main AS d ON d.coll_id = c.coll_id").
+		LeftJoin(replicaJoin(resourceQuery), resourceArgs...).
 		Where(squirrel.Eq{"u.user_type_name": "rodsuser"}).
 		Where(fmt.Sprintf("(d.resc_id IS NULL OR d.resc_id = ANY(ARRAY(%s)))", resourceQuery), resourceArgs...).
 		GroupBy("u.user_name")
 }
 
-func (i *ICATDatabase) UserCurrentDataUsage(context context.Context, username string) (int64, error) {
-	ctx, span := otel.Tracer(otelName).Start(context, "UserCurrentDataUsage")
+// collAreasSubselect maps every collection to the area of the zone it's in,
+// for breaking down owner-attributed usage. Collections outside of the home,
+// shared and trash areas get no area.
+const collAreasSubselect = `(SELECT coll_id,
+       CASE WHEN coll_name LIKE '/' || ? || '/home/shared/%' THEN 'shared'
+            WHEN coll_name LIKE '/' || ? || '/home/%' THEN 'home'
+            WHEN coll_name LIKE '/' || ? || '/trash/home/de-irods/%' THEN 'trash/home/de-irods'
+            WHEN coll_name LIKE '/' || ? || '/trash/home/ipcservices/%' THEN 'trash/home/ipcservices'
+            WHEN coll_name LIKE '/' || ? || '/trash/home/%' THEN 'trash/home'
+       END AS area
+  FROM r_coll_main)`
+
+// ownerUsageQuery attributes data objects to the user recorded as their owner,
+// wherever they live in the zone. Only the collections holding the user's data
+// objects are counted. It relies on the index checked by CheckOwnerIndex.
+func (i *ICATDatabase) ownerUsageQuery(resourceQuery string, resourceArgs []interface{}) squirrel.SelectBuilder {
+	zone := i.configuration.Zone
+	return i.usageColumns().
+		From("r_user_main AS u").
+		LeftJoin("r_data_main AS d ON d.data_owner_name = u.user_name AND d.data_owner_zone = ?", zone).
+		LeftJoin(replicaJoin(resourceQuery), resourceArgs...).
+		LeftJoin(fmt.Sprintf("%s AS c ON c.coll_id = d.coll_id", collAreasSubselect), zone, zone, zone, zone, zone).
+		Where(squirrel.Eq{"u.user_type_name": "rodsuser"}).
+		Where(fmt.Sprintf("(d.resc_id IS NULL OR d.resc_id = ANY(ARRAY(%s)))", resourceQuery), resourceArgs...).
+		GroupBy("u.user_name")
+}
+
+// chargedObjectsQuery restricts the query to the replicas, aliased as d, of
+// the data objects charged to a rodsuser, aliased as u, under the configured
+// attribution mode that are stored under the configured root resources. The
+// replica join is included, aliased as rep. The user collections table is only
+// used for path-based attribution, and owner attribution relies on the index
+// checked by CheckOwnerIndex.
+func (i *ICATDatabase) chargedObjectsQuery(query squirrel.SelectBuilder, userCollsTable, resourceQuery string, resourceArgs []interface{}) squirrel.SelectBuilder {
+	if i.ownerAttribution() {
+		query = query.
+			From("r_data_main AS d").
+			Join("r_user_main AS u ON u.user_name = d.data_owner_name AND d.data_owner_zone = ?", i.configuration.Zone)
+	} else {
+		query = query.
+			From(fmt.Sprintf("%s AS c", userCollsTable)).
+			Join("r_user_main AS u ON u.user_name = c.user_name").
+			Join("r_data_main AS d ON d.coll_id = c.coll_id")
+	}
+
+	return query.
+		Join(replicaJoin(resourceQuery), resourceArgs...).
+		Where(squirrel.Eq{"u.user_type_name": "rodsuser"}).
+		Where(fmt.Sprintf("d.resc_id = ANY(ARRAY(%s))", resourceQuery), resourceArgs...)
+}
+
+// userObjectsQuery is like chargedObjectsQuery, but only for the data objects
+// charged to the user.
+func (i *ICATDatabase) userObjectsQuery(query squirrel.SelectBuilder, userCollsTable, username, resourceQuery string, resourceArgs []interface{}) squirrel.SelectBuilder {
+	return i.chargedObjectsQuery(query, userCollsTable, resourceQuery, resourceArgs).
+		Where(squirrel.Eq{"u.user_name": username})
+}
+
+// modifiedExpr converts the modification time of the data object aliased as
+// d, which the ICAT stores as a string of seconds, to a timestamp.
+const modifiedExpr = "to_timestamp(CAST(d.modify_ts AS bigint))"
+
+// UserUsage is a user's data usage as computed from the ICAT, along with a
+// breakdown of where in the zone the data lives.
+type UserUsage struct {
+	Username string `db:"username"`
+	Total    int64  `db:"file_volume"`
+	natsconn.UsageBreakdown
+}
+
+// ResourceUsage is the amount of data a user has stored under a single root
+// resource.
+type ResourceUsage struct {
+	Resource string `db:"root_name" json:"resource"`
+	Total    int64  `db:"total" json:"total"`
+}
+
+// prepareSpecificUserQuery sets up the temporary tables needed to query a
+// single user's data and returns the name of the user collections table along
+// with the resource subselect used to filter data objects.
+func (i *ICATDatabase) prepareSpecificUserQuery(context context.Context, username string) (string, string, []interface{}, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "prepareSpecificUserQuery")
 	defer span.End()
 
-	u := i.UnqualifiedUsername(username)
-	// We should have a Tx here, or this will behave badly. Not sure how to ensure that/if it's possible to.
+	err := i.createStorageRootMapping(ctx)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	resourceQuery, resourceArgs, err := i.resourcesSubselect()
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	userCollsTable, err := i.createSpecificUserColls(ctx, i.UnqualifiedUsername(username))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return userCollsTable, resourceQuery, resourceArgs, nil
+}
+
+// prepareAllUsersQuery is like prepareSpecificUserQuery, but sets up the
+// temporary tables for every user in the zone.
+func (i *ICATDatabase) prepareAllUsersQuery(context context.Context) (string, string, []interface{}, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "prepareAllUsersQuery")
+	defer span.End()
 
 	err := i.createStorageRootMapping(ctx)
 	if err != nil {
-		return 0, err
+		return "", "", nil, err
 	}
 
 	resourceQuery, resourceArgs, err := i.resourcesSubselect()
 	if err != nil {
-		return 0, err
+		return "", "", nil, err
 	}
 
-	userCollsTable, err := i.createSpecificUserColls(ctx, u)
+	userCollsTable, err := i.createUserCollsTable(ctx)
 	if err != nil {
-		return 0, err
+		return "", "", nil, err
+	}
+
+	// Owner attribution doesn't go through the user collections.
+	if !i.ownerAttribution() {
+		err = i.populateAllUserColls(ctx, userCollsTable)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		err = i.populateSharedUserColls(ctx, userCollsTable, "")
+		if err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	return userCollsTable, resourceQuery, resourceArgs, nil
+}
+
+func (i *ICATDatabase) UserCurrentDataUsage(context context.Context, username string) (*UserUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserCurrentDataUsage")
+	defer span.End()
+
+	u := i.UnqualifiedUsername(username)
+	// We should have a Tx here, or this will behave badly. Not sure how to ensure that/if it's possible to.
+
+	userCollsTable, resourceQuery, resourceArgs, err := i.prepareSpecificUserQuery(ctx, u)
+	if err != nil {
+		return nil, err
 	}
 
 	// should this additionally return a timestamp, or even a semi-complete UserDataUsage object?
@@ -217,28 +575,29 @@ func (i *ICATDatabase) UserCurrentDataUsage(context context.Context, username st
 		ToSql()
 
 	if err != nil {
-		return 0, errors.Wrap(err, "Error formatting user data usage query")
+		return nil, errors.Wrap(err, "Error formatting user data usage query")
 	}
 
 	log.Tracef("UserCurrentDataUsage SQL: %s, %+v", querys, args)
 
-	var usage int64
+	var usage UserUsage
 	err = i.db.GetContext(ctx, &usage, querys, args...)
 	if err == sql.ErrNoRows {
-		return 0, err
+		return nil, err
 	} else if err != nil {
-		return 0, errors.Wrap(err, "Error running query")
+		return nil, errors.Wrap(err, "Error running query")
 	}
+	usage.Username = u
 
-	return usage, nil
+	return &usage, nil
 }
 
-func (i *ICATDatabase) BatchCurrentDataUsage(context context.Context, start, end string) (map[string]int64, error) {
+func (i *ICATDatabase) BatchCurrentDataUsage(context context.Context, start, end string) (map[string]*UserUsage, error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "BatchCurrentDataUsage")
 	defer span.End()
 
 	// Again, this should be a Tx
-	rv := make(map[string]int64)
+	rv := make(map[string]*UserUsage)
 	s := i.UnqualifiedUsername(start)
 	e := i.UnqualifiedUsername(end)
 
@@ -257,15 +616,80 @@ func (i *ICATDatabase) BatchCurrentDataUsage(context context.Context, start, end
 		return rv, err
 	}
 
+	query := i.baseUsageQuery(userCollsTable, resourceQuery, resourceArgs).
+		Where("u.user_name BETWEEN ? AND ?", s, e)
+
+	return i.queryUsages(ctx, query)
+}
+
+// AllCurrentDataUsage computes every user's usage in a single pass over the
+// zone. The results are read as they stream in and handed to fn in chunks of up
+// to chunkSize users, keyed by unqualified username. Like
+// BatchCurrentDataUsage, it should be run in a transaction.
+func (i *ICATDatabase) AllCurrentDataUsage(context context.Context, chunkSize int, fn func(map[string]*UserUsage) error) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "AllCurrentDataUsage")
+	defer span.End()
+
+	userCollsTable, resourceQuery, resourceArgs, err := i.prepareAllUsersQuery(ctx)
+	if err != nil {
+		return err
+	}
+
 	querys, args, err := i.baseUsageQuery(userCollsTable, resourceQuery, resourceArgs).
-		Where("u.user_name BETWEEN ? AND ?", s, e).
+		Column("u.user_name AS username").
+		OrderBy("u.user_name").
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error formatting query")
+	}
+
+	log.Tracef("AllCurrentDataUsage SQL: %s, %+v", querys, args)
+
+	rows, err := i.db.QueryxContext(ctx, querys, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error fetching usage for all users")
+	}
+	defer func() { _ = rows.Close() }()
+
+	chunk := make(map[string]*UserUsage)
+	for rows.Next() {
+		var usage UserUsage
+		err = rows.StructScan(&usage)
+		if err != nil {
+			return err
+		}
+		chunk[usage.Username] = &usage
+
+		if len(chunk) >= chunkSize {
+			if err = fn(chunk); err != nil {
+				return err
+			}
+			chunk = make(map[string]*UserUsage)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "Error reading usage for all users")
+	}
+
+	if len(chunk) > 0 {
+		return fn(chunk)
+	}
+	return nil
+}
+
+// queryUsages runs a usage query covering several users and returns the
+// results keyed by unqualified username.
+func (i *ICATDatabase) queryUsages(ctx context.Context, query squirrel.SelectBuilder) (map[string]*UserUsage, error) {
+	rv := make(map[string]*UserUsage)
+
+	querys, args, err := query.
 		Column("u.user_name AS username").
 		ToSql()
 	if err != nil {
 		return rv, errors.Wrap(err, "Error formatting query")
 	}
 
-	log.Tracef("BatchCurrentDataUsage SQL: %s, %+v", querys, args)
+	log.Tracef("queryUsages SQL: %s, %+v", querys, args)
 
 	rows, err := i.db.QueryxContext(ctx, querys, args...)
 	if err != nil {
@@ -273,18 +697,167 @@ func (i *ICATDatabase) BatchCurrentDataUsage(context context.Context, start, end
 	}
 	defer func() { _ = rows.Close() }()
 	for rows.Next() {
-		var uname string
-		var total int64
-		err = rows.Scan(&total, &uname)
+		var usage UserUsage
+		err = rows.StructScan(&usage)
 		if err != nil {
 			return rv, err
 		}
-		log.Tracef("Got %d for %s", total, uname)
-		rv[uname] = total
+		log.Tracef("Got %d for %s", usage.Total, usage.Username)
+		rv[usage.Username] = &usage
 	}
 	return rv, nil
 }
 
+// UsersCurrentDataUsage computes the usage of each of the listed users,
+// returning the results keyed by unqualified username. Like
+// BatchCurrentDataUsage, it should be run in a transaction.
+func (i *ICATDatabase) UsersCurrentDataUsage(context context.Context, usernames []string) (map[string]*UserUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UsersCurrentDataUsage")
+	defer span.End()
+
+	rv := make(map[string]*UserUsage)
+
+	err := i.createStorageRootMapping(ctx)
+	if err != nil {
+		return rv, err
+	}
+
+	resourceQuery, resourceArgs, err := i.resourcesSubselect()
+	if err != nil {
+		return rv, err
+	}
+
+	userCollsTable, err := i.createUserCollsTable(ctx)
+	if err != nil {
+		return rv, err
+	}
+
+	us := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		us = append(us, i.UnqualifiedUsername(username))
+	}
+
+	// Owner attribution doesn't go through the user collections.
+	if !i.ownerAttribution() {
+		for _, u := range us {
+			if err = i.populateSpecificUserColls(ctx, u, userCollsTable); err != nil {
+				return rv, err
+			}
+		}
+
+		err = i.populateSharedUserColls(ctx, userCollsTable, "s.user_name = ANY($2)", pq.Array(us))
+		if err != nil {
+			return rv, err
+		}
+	}
+
+	query := i.baseUsageQuery(userCollsTable, resourceQuery, resourceArgs).
+		Where(squirrel.Eq{"u.user_name": us})
+
+	return i.queryUsages(ctx, query)
+}
+
+// changedOwners returns the unqualified usernames, in order, of the users who
+// own a data object that was modified after the ICAT timestamp.
+func (i *ICATDatabase) changedOwners(ctx context.Context, ts string) ([]string, error) {
+	q := `
+SELECT DISTINCT u.user_name
+  FROM r_data_main AS d
+  JOIN r_user_main AS u ON d.data_owner_name = u.user_name AND d.data_owner_zone = $1
+ WHERE d.modify_ts > $2
+   AND u.user_type_name = 'rodsuser'
+ ORDER BY u.user_name`
+
+	log.Tracef("changedOwners SQL: %s, [%s %s]", q, i.configuration.Zone, ts)
+
+	rv := make([]string, 0)
+	err := i.db.SelectContext(ctx, &rv, q, i.configuration.Zone, ts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching changed data owners")
+	}
+	return rv, nil
+}
+
+// ChangedUsers returns the unqualified usernames, in order, of the users with
+// a collection or data object in their home or trash that was modified after
+// the given time. Removals that don't touch a remaining collection or data
+// object, such as deleting a file without going through the trash, aren't
+// noticed.
+//
+// The lookup filters on r_coll_main.modify_ts and r_data_main.modify_ts, which
+// the ICAT doesn't index out of the box. Without indexes on both columns it
+// scans the whole catalog, so create them before scheduling incremental
+// refreshes:
+//
+//	CREATE INDEX idx_coll_main_modify_ts ON r_coll_main (modify_ts);
+//	CREATE INDEX idx_data_main_modify_ts ON r_data_main (modify_ts);
+func (i *ICATDatabase) ChangedUsers(context context.Context, since time.Time) ([]string, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "ChangedUsers")
+	defer span.End()
+
+	// The ICAT stores timestamps as zero-padded seconds since the epoch.
+	ts := fmt.Sprintf("%011d", since.Unix())
+
+	if i.ownerAttribution() {
+		return i.changedOwners(ctx, ts)
+	}
+
+	q := `
+WITH changed_colls AS (
+  SELECT coll_name FROM r_coll_main WHERE modify_ts > $2
+  UNION
+  SELECT c.coll_name
+    FROM r_data_main AS d
+    JOIN r_coll_main AS c ON d.coll_id = c.coll_id
+   WHERE d.modify_ts > $2
+), changed_users AS (
+  SELECT CASE WHEN coll_name LIKE '/' || $1 || '/home/%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/home/([^/]+).*', E'\\1')
+              WHEN coll_name LIKE '/' || $1 || '/trash/home/de-irods/%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/de-irods/([^/]+).*', E'\\1')
+              WHEN coll_name LIKE '/' || $1 || '/trash/home/ipcservices/%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/ipcservices/([^/]+).*', E'\\1')
+              WHEN coll_name LIKE '/' || $1 || '/trash/home/%' THEN REGEXP_REPLACE(coll_name, '/' || $1 || '/trash/home/([^/]+).*', E'\\1')
+         END AS user_name
+    FROM changed_colls
+)
+SELECT DISTINCT u.user_name
+  FROM changed_users AS c
+  JOIN r_user_main AS u ON c.user_name = u.user_name
+ WHERE u.user_type_name = 'rodsuser'
+ ORDER BY u.user_name`
+
+	log.Tracef("ChangedUsers SQL: %s, [%s %s]", q, i.configuration.Zone, ts)
+
+	rv := make([]string, 0)
+	err := i.db.SelectContext(ctx, &rv, q, i.configuration.Zone, ts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching changed users")
+	}
+
+	if i.configuration.SharedAttribution != config.SharedAttributionOwner {
+		return rv, nil
+	}
+
+	// Shared collections are charged to their owners, so those owners have
+	// changed too.
+	sq := fmt.Sprintf(`
+SELECT DISTINCT s.user_name
+  FROM (%s) AS s
+  JOIN r_coll_main AS c ON s.coll_id = c.coll_id
+ WHERE c.modify_ts > $2
+    OR EXISTS (SELECT 1 FROM r_data_main AS d WHERE d.coll_id = c.coll_id AND d.modify_ts > $2)`, sharedOwnersQuery)
+
+	log.Tracef("ChangedUsers shared SQL: %s, [%s %s]", sq, i.configuration.Zone, ts)
+
+	var owners []string
+	err = i.db.SelectContext(ctx, &owners, sq, i.configuration.Zone, ts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching changed shared collection owners")
+	}
+
+	rv = lo.Uniq(append(rv, owners...))
+	sort.Strings(rv)
+	return rv, nil
+}
+
 func (i *ICATDatabase) GetUserBatchBounds(context context.Context, batchSize int) ([][]string, error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "GetUserBatchBounds")
 	defer span.End()
@@ -332,3 +905,441 @@ func (i *ICATDatabase) GetUserBatchBounds(context context.Context, batchSize int
 
 	return bounds, nil
 }
+
+// UserDataUsageByResource returns the user's data usage broken down by the
+// configured root resources, under the configured replica accounting. Every
+// configured root resource is included in the results, even if the user has
+// no data stored under it.
+func (i *ICATDatabase) UserDataUsageByResource(context context.Context, username string) ([]ResourceUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserDataUsageByResource")
+	defer span.End()
+
+	u := i.UnqualifiedUsername(username)
+
+	userCollsTable, resourceQuery, resourceArgs, err := i.prepareSpecificUserQuery(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	query := psql.Select("m.root_name", "COALESCE(SUM(d.data_size),0) AS total")
+	if i.ownerAttribution() {
+		query = query.
+			From("r_data_main AS d").
+			Where(squirrel.Eq{"d.data_owner_name": u, "d.data_owner_zone": i.configuration.Zone})
+	} else {
+		query = query.
+			From(fmt.Sprintf("%s AS c", userCollsTable)).
+			Join("r_data_main AS d ON d.coll_id = c.coll_id").
+			Where(squirrel.Eq{"c.user_name": u})
+	}
+
+	querys, args, err := query.
+		Join("storage_root_mapping AS m ON m.storage_id = d.resc_id").
+		Join(replicaJoin(resourceQuery), resourceArgs...).
+		Where(squirrel.Eq{"m.root_name": i.configuration.RootResourceNames}).
+		Where(i.chargedFilter()).
+		GroupBy("m.root_name").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting usage by resource query")
+	}
+
+	log.Tracef("UserDataUsageByResource SQL: %s, %+v", querys, args)
+
+	var found []ResourceUsage
+	err = i.db.SelectContext(ctx, &found, querys, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching usage by resource")
+	}
+
+	totals := make(map[string]int64)
+	for _, r := range found {
+		totals[r.Resource] = r.Total
+	}
+
+	rv := make([]ResourceUsage, 0, len(i.configuration.RootResourceNames))
+	for _, name := range i.configuration.RootResourceNames {
+		rv = append(rv, ResourceUsage{Resource: name, Total: totals[name]})
+	}
+
+	return rv, nil
+}
+
+// FolderSize is the recursive size of a collection and the number of data
+// objects in it.
+type FolderSize struct {
+	Path        string `db:"coll_name" json:"path"`
+	Total       int64  `db:"total" json:"total"`
+	ObjectCount int64  `db:"object_count" json:"object_count"`
+}
+
+// escapeLike escapes the LIKE wildcards in s, so that it only matches itself
+// in a pattern using a backslash as the escape character.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// UserFolderSizes returns the recursive size of every collection up to depth
+// levels below subpath in the user's home collection. The subpath is relative
+// to the user's home collection and is expected to be cleaned already.
+func (i *ICATDatabase) UserFolderSizes(context context.Context, username, subpath string, depth int) ([]FolderSize, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserFolderSizes")
+	defer span.End()
+
+	base := strings.TrimSuffix(i.UserHomePath(username)+"/"+strings.Trim(subpath, "/"), "/")
+	baseDepth := strings.Count(base, "/")
+
+	err := i.createStorageRootMapping(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceQuery, resourceArgs, err := i.resourcesSubselect()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every collection below the base is sized once, then its size is added to
+	// each of its ancestors within depth levels of the base. Only the replicas
+	// charged under the configured accounting are counted.
+	charged := i.chargedFilter()
+	prefix := fmt.Sprintf(`WITH subs AS (
+  SELECT coll_id, coll_name, LENGTH(coll_name) - LENGTH(REPLACE(coll_name, '/', '')) - ? AS level
+    FROM r_coll_main
+   WHERE coll_name LIKE ? || '/%%' ESCAPE E'\\'
+), sizes AS (
+  SELECT s.coll_name, s.level,
+         COALESCE(SUM(d.data_size) FILTER (WHERE %s),0) AS total,
+         COUNT(DISTINCT d.data_id) FILTER (WHERE %s) AS object_count
+    FROM subs AS s
+    LEFT JOIN r_data_main AS d ON d.coll_id = s.coll_id AND d.resc_id = ANY(ARRAY(%s))
+    LEFT JOIN %s
+   GROUP BY s.coll_name, s.level
+)`, charged, charged, resourceQuery, replicaJoin(resourceQuery))
+	prefixArgs := append([]interface{}{baseDepth, escapeLike(base)}, resourceArgs...)
+	prefixArgs = append(prefixArgs, resourceArgs...)
+
+	querys, args, err := psql.Select("a.coll_name", "CAST(SUM(s.total) AS bigint) AS total", "CAST(SUM(s.object_count) AS bigint) AS object_count").
+		Prefix(prefix, prefixArgs...).
+		From("sizes AS s").
+		Join("LATERAL (SELECT array_to_string((string_to_array(s.coll_name, '/'))[1:CAST(? AS integer)+1+n], '/') AS coll_name FROM generate_series(1, LEAST(s.level, ?)) AS n) AS a ON true", baseDepth, depth).
+		GroupBy("a.coll_name").
+		OrderBy("a.coll_name").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting folder sizes query")
+	}
+
+	log.Tracef("UserFolderSizes SQL: %s, %+v", querys, args)
+
+	rv := make([]FolderSize, 0)
+	err = i.db.SelectContext(ctx, &rv, querys, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching folder sizes")
+	}
+
+	return rv, nil
+}
+
+// DataObject is a single data object charged to a user, as reported by the
+// largest data objects report.
+type DataObject struct {
+	Path     string    `db:"path" json:"path"`
+	Size     int64     `db:"size" json:"size"`
+	Resource string    `db:"resource" json:"resource"`
+	Modified time.Time `db:"modified" json:"modified"`
+}
+
+// UserLargestDataObjects returns the user's limit largest data objects, largest
+// first. Each data object is listed once, with the size, root resource and
+// modification time of its first replica that isn't stale.
+func (i *ICATDatabase) UserLargestDataObjects(context context.Context, username string, limit uint64) ([]DataObject, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserLargestDataObjects")
+	defer span.End()
+
+	u := i.UnqualifiedUsername(username)
+
+	userCollsTable, resourceQuery, resourceArgs, err := i.prepareSpecificUserQuery(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	query := psql.Select(
+		"cm.coll_name || '/' || d.data_name AS path",
+		"d.data_size AS size",
+		"m.root_name AS resource",
+		fmt.Sprintf("%s AS modified", modifiedExpr),
+	)
+
+	querys, args, err := i.userObjectsQuery(query, userCollsTable, u, resourceQuery, resourceArgs).
+		Join("r_coll_main AS cm ON cm.coll_id = d.coll_id").
+		Join("storage_root_mapping AS m ON m.storage_id = d.resc_id").
+		Where("d.data_is_dirty <> 0 AND rep.first_replica").
+		OrderBy("d.data_size DESC", "path").
+		Limit(limit).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting largest data objects query")
+	}
+
+	log.Tracef("UserLargestDataObjects SQL: %s, %+v", querys, args)
+
+	rv := make([]DataObject, 0)
+	err = i.db.SelectContext(ctx, &rv, querys, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching largest data objects")
+	}
+
+	return rv, nil
+}
+
+// TypeUsage is the amount of data a user has stored as a single file type.
+type TypeUsage struct {
+	Name        string `db:"name" json:"name"`
+	Total       int64  `db:"total" json:"total"`
+	ObjectCount int64  `db:"object_count" json:"object_count"`
+}
+
+// extensionExpr extracts the lowercased file extension from the name of the
+// data object aliased as d. Names without one, including dotfiles, get an
+// empty extension.
+const extensionExpr = `COALESCE(LOWER(SUBSTRING(d.data_name FROM '.\.([^.]+)$')), '')`
+
+// UserDataUsageByType returns the user's data usage grouped by file extension
+// and by the iRODS data type, largest first.
+func (i *ICATDatabase) UserDataUsageByType(context context.Context, username string) ([]TypeUsage, []TypeUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserDataUsageByType")
+	defer span.End()
+
+	u := i.UnqualifiedUsername(username)
+
+	userCollsTable, resourceQuery, resourceArgs, err := i.prepareSpecificUserQuery(ctx, u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usageBy := func(expr string) ([]TypeUsage, error) {
+		query := psql.Select(
+			fmt.Sprintf("%s AS name", expr),
+			"COALESCE(SUM(d.data_size),0) AS total",
+			"COUNT(DISTINCT d.data_id) AS object_count",
+		)
+
+		querys, args, err := i.userObjectsQuery(query, userCollsTable, u, resourceQuery, resourceArgs).
+			Where(i.chargedFilter()).
+			GroupBy("name").
+			OrderBy("total DESC", "name").
+			ToSql()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error formatting usage by type query")
+		}
+
+		log.Tracef("UserDataUsageByType SQL: %s, %+v", querys, args)
+
+		rv := make([]TypeUsage, 0)
+		err = i.db.SelectContext(ctx, &rv, querys, args...)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error fetching usage by type")
+		}
+		return rv, nil
+	}
+
+	extensions, err := usageBy(extensionExpr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataTypes, err := usageBy("d.data_type_name")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return extensions, dataTypes, nil
+}
+
+// AgeBucket is the amount of data last modified within a range of ages.
+type AgeBucket struct {
+	Name        string `db:"name" json:"name"`
+	Total       int64  `db:"total" json:"total"`
+	ObjectCount int64  `db:"object_count" json:"object_count"`
+}
+
+// ageBuckets are the age ranges data is bucketed into, youngest first. Each
+// bucket holds data younger than its maximum age and at least as old as the
+// previous bucket's; the last bucket has no maximum.
+var ageBuckets = []struct {
+	name   string
+	maxAge string
+}{
+	{"<30d", "30 days"},
+	{"30d-180d", "180 days"},
+	{"180d-1y", "1 year"},
+	{">1y", ""},
+}
+
+// ageBucketsQuery buckets the charged data matched by the query by the
+// configured age ranges.
+func (i *ICATDatabase) ageBucketsQuery(ctx context.Context, query squirrel.SelectBuilder) ([]AgeBucket, error) {
+	bucketExpr := "CASE"
+	for _, b := range ageBuckets {
+		if b.maxAge == "" {
+			bucketExpr = fmt.Sprintf("%s ELSE '%s' END", bucketExpr, b.name)
+			break
+		}
+		bucketExpr = fmt.Sprintf("%s WHEN %s >= now() - interval '%s' THEN '%s'", bucketExpr, modifiedExpr, b.maxAge, b.name)
+	}
+
+	querys, args, err := query.
+		Columns(
+			fmt.Sprintf("%s AS name", bucketExpr),
+			"COALESCE(SUM(d.data_size),0) AS total",
+			"COUNT(DISTINCT d.data_id) AS object_count",
+		).
+		Where(i.chargedFilter()).
+		GroupBy("name").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting age buckets query")
+	}
+
+	log.Tracef("age buckets SQL: %s, %+v", querys, args)
+
+	var found []AgeBucket
+	err = i.db.SelectContext(ctx, &found, querys, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching age buckets")
+	}
+
+	byName := make(map[string]AgeBucket)
+	for _, b := range found {
+		byName[b.Name] = b
+	}
+
+	rv := make([]AgeBucket, 0, len(ageBuckets))
+	for _, b := range ageBuckets {
+		rv = append(rv, AgeBucket{Name: b.name, Total: byName[b.name].Total, ObjectCount: byName[b.name].ObjectCount})
+	}
+
+	return rv, nil
+}
+
+// UserDataAgeBuckets returns the user's data usage bucketed by how long ago
+// it was last modified. Every bucket is included, even if it's empty.
+func (i *ICATDatabase) UserDataAgeBuckets(context context.Context, username string) ([]AgeBucket, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "UserDataAgeBuckets")
+	defer span.End()
+
+	u := i.UnqualifiedUsername(username)
+
+	userCollsTable, resourceQuery, resourceArgs, err := i.prepareSpecificUserQuery(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.ageBucketsQuery(ctx, i.userObjectsQuery(psql.Select(), userCollsTable, u, resourceQuery, resourceArgs))
+}
+
+// ZoneDataAgeBuckets is like UserDataAgeBuckets, but for the data charged to
+// every user in the zone.
+func (i *ICATDatabase) ZoneDataAgeBuckets(context context.Context) ([]AgeBucket, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "ZoneDataAgeBuckets")
+	defer span.End()
+
+	userCollsTable, resourceQuery, resourceArgs, err := i.prepareAllUsersQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.ageBucketsQuery(ctx, i.chargedObjectsQuery(psql.Select(), userCollsTable, resourceQuery, resourceArgs))
+}
+
+// AttributionDifference compares a user's usage under path and owner
+// attribution. The difference is the owner-attributed usage minus the
+// path-attributed usage.
+type AttributionDifference struct {
+	Username   string `db:"username" json:"username"`
+	PathBytes  int64  `db:"path_bytes" json:"path_bytes"`
+	OwnerBytes int64  `db:"owner_bytes" json:"owner_bytes"`
+	Difference int64  `db:"difference" json:"difference"`
+}
+
+// CompareAttribution computes every user's usage under both attribution
+// modes, regardless of the configured one, and returns the users whose usage
+// differs, largest difference first. A limit of zero returns all of them. It
+// should be run in a transaction.
+func (i *ICATDatabase) CompareAttribution(context context.Context, limit uint64) ([]AttributionDifference, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "CompareAttribution")
+	defer span.End()
+
+	err := i.createStorageRootMapping(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceQuery, resourceArgs, err := i.resourcesSubselect()
+	if err != nil {
+		return nil, err
+	}
+
+	userCollsTable, err := i.createUserCollsTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.populateAllUserColls(ctx, userCollsTable)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.populateSharedUserColls(ctx, userCollsTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep ?-style args so that both queries can be embedded in the next one.
+	pathQuery, pathArgs, err := i.pathUsageQuery(userCollsTable, resourceQuery, resourceArgs).
+		Column("u.user_name AS username").
+		PlaceholderFormat(squirrel.Question).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting path usage query")
+	}
+
+	ownerQuery, ownerArgs, err := i.ownerUsageQuery(resourceQuery, resourceArgs).
+		Column("u.user_name AS username").
+		PlaceholderFormat(squirrel.Question).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting owner usage query")
+	}
+
+	query := psql.Select(
+		"p.username",
+		"p.file_volume AS path_bytes",
+		"o.file_volume AS owner_bytes",
+		"o.file_volume - p.file_volume AS difference",
+	).
+		Prefix(fmt.Sprintf("WITH path_usage AS (%s), owner_usage AS (%s)", pathQuery, ownerQuery), append(pathArgs, ownerArgs...)...).
+		From("path_usage AS p").
+		Join("owner_usage AS o ON o.username = p.username").
+		Where("p.file_volume <> o.file_volume").
+		OrderBy("abs(o.file_volume - p.file_volume) DESC", "p.username")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	querys, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error formatting attribution comparison query")
+	}
+
+	log.Tracef("CompareAttribution SQL: %s, %+v", querys, args)
+
+	rv := make([]AttributionDifference, 0)
+	err = i.db.SelectContext(ctx, &rv, querys, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error comparing attribution modes")
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/data-usage-api/migrations"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+)
+
+// migrationLockKey identifies the Postgres advisory lock that keeps replicas
+// starting at the same time from applying the same migrations.
+const migrationLockKey int64 = 0x64617461_6d696772 // "datamigr"
+
+// migration is a single versioned up migration.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the up migrations, in version order, filling in the
+// configured schema.
+func loadMigrations(schema string) ([]migration, error) {
+	names, err := fs.Glob(migrations.FS, "*.up.sql")
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing migrations")
+	}
+
+	rv := make([]migration, 0, len(names))
+	for _, name := range names {
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Migration %s has no version", name)
+		}
+
+		tmpl, err := template.ParseFS(migrations.FS, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing migration %s", name)
+		}
+
+		var sb strings.Builder
+		if err = tmpl.Execute(&sb, map[string]string{"Schema": schema}); err != nil {
+			return nil, errors.Wrapf(err, "Error filling in migration %s", name)
+		}
+
+		rv = append(rv, migration{version: version, name: name, sql: sb.String()})
+	}
+
+	sort.Slice(rv, func(i, j int) bool { return rv[i].version < rv[j].version })
+
+	return rv, nil
+}
+
+// Migrate applies the migrations that haven't been applied to the DE database
+// yet, recording each version in the data_usage_schema_migrations table. All of
+// them are applied in a single transaction, so a failed migration leaves the
+// database as it was.
+func Migrate(context context.Context, dedb *sqlx.DB, configuration *config.Config) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "Migrate")
+	defer span.End()
+
+	pending, err := loadMigrations(configuration.DBSchema)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dedb.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Error creating migration transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// The lock is released when the transaction ends.
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+		return errors.Wrap(err, "Error locking migrations")
+	}
+
+	table := configuration.DBSchema + ".data_usage_schema_migrations"
+
+	_, err = tx.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS `+table+` (
+  version integer NOT NULL PRIMARY KEY,
+  applied_at timestamp with time zone NOT NULL DEFAULT now()
+)`)
+	if err != nil {
+		return errors.Wrap(err, "Error creating migrations table")
+	}
+
+	var applied []int
+	if err = tx.SelectContext(ctx, &applied, "SELECT version FROM "+table); err != nil {
+		return errors.Wrap(err, "Error fetching applied migrations")
+	}
+	done := make(map[int]bool)
+	for _, v := range applied {
+		done[v] = true
+	}
+
+	for _, m := range pending {
+		if done[m.version] {
+			continue
+		}
+
+		log.Infof("Applying migration %s", m.name)
+
+		if _, err = tx.ExecContext(ctx, m.sql); err != nil {
+			return errors.Wrapf(err, "Error applying migration %s", m.name)
+		}
+
+		if _, err = tx.ExecContext(ctx, "INSERT INTO "+table+" (version) VALUES ($1)", m.version); err != nil {
+			return errors.Wrapf(err, "Error recording migration %s", m.name)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "Error committing migrations")
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	ms, err := loadMigrations("test_schema")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ms) == 0 {
+		t.Fatal("expected at least one migration")
+	}
+
+	for i, m := range ms {
+		if i > 0 && m.version <= ms[i-1].version {
+			t.Errorf("migration %s doesn't come after %s", m.name, ms[i-1].name)
+		}
+		if strings.Contains(m.sql, "{{") {
+			t.Errorf("migration %s wasn't filled in", m.name)
+		}
+		if !strings.Contains(m.sql, "test_schema.") {
+			t.Errorf("migration %s doesn't qualify its tables with the schema", m.name)
+		}
+	}
+}
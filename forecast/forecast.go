@@ -0,0 +1,112 @@
+package forecast
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Point is a single observed value at a point in time.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Trend is a least-squares linear fit over a set of points. Slope is in units
+// per second, measured from Origin.
+type Trend struct {
+	Origin    time.Time
+	Slope     float64
+	Intercept float64
+	RSquared  float64
+}
+
+// MinPoints and MinSpan are how many points, and how far apart the first and
+// last of them, are needed to fit a trend. A line through a couple of readings
+// fits them perfectly without saying much about where usage is headed.
+const (
+	MinPoints = 5
+	MinSpan   = 3 * 24 * time.Hour
+)
+
+// ErrNotEnoughPoints is returned when there aren't enough points, spread out
+// enough in time, to fit a trend.
+var ErrNotEnoughPoints = errors.New("at least 5 readings spanning 3 days are needed to fit a trend")
+
+// Fit computes an ordinary least-squares linear trend through the points.
+func Fit(points []Point) (*Trend, error) {
+	if len(points) < MinPoints {
+		return nil, ErrNotEnoughPoints
+	}
+
+	origin, latest := points[0].Time, points[0].Time
+	for _, p := range points {
+		if p.Time.Before(origin) {
+			origin = p.Time
+		}
+		if p.Time.After(latest) {
+			latest = p.Time
+		}
+	}
+	if latest.Sub(origin) < MinSpan {
+		return nil, ErrNotEnoughPoints
+	}
+
+	n := float64(len(points))
+	var sumX, sumY float64
+	for _, p := range points {
+		sumX += p.Time.Sub(origin).Seconds()
+		sumY += p.Value
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var sxx, sxy, syy float64
+	for _, p := range points {
+		dx := p.Time.Sub(origin).Seconds() - meanX
+		dy := p.Value - meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+
+	slope := sxy / sxx
+	t := &Trend{
+		Origin:    origin,
+		Slope:     slope,
+		Intercept: meanY - slope*meanX,
+	}
+
+	// A flat series has no variation for the trend to explain, so it says
+	// nothing about how well the trend predicts growth.
+	if syy == 0 {
+		t.RSquared = 0
+	} else {
+		t.RSquared = math.Min(1, (sxy*sxy)/(sxx*syy))
+	}
+
+	return t, nil
+}
+
+// At returns the value the trend predicts at the given time.
+func (t *Trend) At(when time.Time) float64 {
+	return t.Intercept + t.Slope*when.Sub(t.Origin).Seconds()
+}
+
+// PerDay returns the slope of the trend in units per day.
+func (t *Trend) PerDay() float64 {
+	return t.Slope * (24 * time.Hour).Seconds()
+}
+
+// When returns the time at which the trend reaches the value. The second return
+// value is false if the trend never reaches it because it isn't growing.
+func (t *Trend) When(value float64) (time.Time, bool) {
+	if t.Slope <= 0 {
+		return time.Time{}, false
+	}
+	seconds := (value - t.Intercept) / t.Slope
+	// Guard against overflowing time.Duration for trends that are barely growing.
+	if seconds*float64(time.Second) > math.MaxInt64 {
+		return time.Time{}, false
+	}
+	return t.Origin.Add(time.Duration(seconds * float64(time.Second))), true
+}
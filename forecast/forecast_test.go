@@ -0,0 +1,205 @@
+package forecast
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+var origin = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const day = 24 * time.Hour
+
+// daily returns a point for each of the values, one day apart.
+func daily(values ...float64) []Point {
+	points := make([]Point, 0, len(values))
+	for i, v := range values {
+		points = append(points, Point{Time: origin.Add(time.Duration(i) * day), Value: v})
+	}
+	return points
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		name     string
+		points   []Point
+		err      error
+		perDay   float64
+		rSquared float64
+	}{
+		{
+			name:   "no points",
+			points: nil,
+			err:    ErrNotEnoughPoints,
+		},
+		{
+			name:   "single point",
+			points: daily(100),
+			err:    ErrNotEnoughPoints,
+		},
+		{
+			// Two points are always fit perfectly, which says nothing about
+			// the trend.
+			name:   "two points",
+			points: daily(100, 200),
+			err:    ErrNotEnoughPoints,
+		},
+		{
+			name: "short span",
+			points: []Point{
+				{Time: origin, Value: 100},
+				{Time: origin.Add(6 * time.Hour), Value: 200},
+				{Time: origin.Add(12 * time.Hour), Value: 300},
+				{Time: origin.Add(18 * time.Hour), Value: 400},
+				{Time: origin.Add(24 * time.Hour), Value: 500},
+			},
+			err: ErrNotEnoughPoints,
+		},
+		{
+			name: "zero-variance time axis",
+			points: []Point{
+				{Time: origin, Value: 100},
+				{Time: origin, Value: 200},
+				{Time: origin, Value: 300},
+				{Time: origin, Value: 400},
+				{Time: origin, Value: 500},
+			},
+			err: ErrNotEnoughPoints,
+		},
+		{
+			name:     "growing",
+			points:   daily(100, 200, 300, 400, 500),
+			perDay:   100,
+			rSquared: 1,
+		},
+		{
+			name:     "noisy",
+			points:   daily(100, 300, 200, 400, 300),
+			perDay:   50,
+			rSquared: 25.0 / 52,
+		},
+		{
+			name:     "negative slope",
+			points:   daily(500, 400, 300, 200, 100),
+			perDay:   -100,
+			rSquared: 1,
+		},
+		{
+			// Flat usage shows no trend to be confident in.
+			name:     "flat",
+			points:   daily(100, 100, 100, 100, 100),
+			perDay:   0,
+			rSquared: 0,
+		},
+		{
+			name: "unordered",
+			points: []Point{
+				{Time: origin.Add(2 * day), Value: 300},
+				{Time: origin, Value: 100},
+				{Time: origin.Add(4 * day), Value: 500},
+				{Time: origin.Add(day), Value: 200},
+				{Time: origin.Add(3 * day), Value: 400},
+			},
+			perDay:   100,
+			rSquared: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trend, err := Fit(tc.points)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected error %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !trend.Origin.Equal(origin) {
+				t.Errorf("expected origin %s, got %s", origin, trend.Origin)
+			}
+			if math.Abs(trend.PerDay()-tc.perDay) > 1e-6 {
+				t.Errorf("expected %f per day, got %f", tc.perDay, trend.PerDay())
+			}
+			if math.Abs(trend.RSquared-tc.rSquared) > 1e-9 {
+				t.Errorf("expected r-squared %f, got %f", tc.rSquared, trend.RSquared)
+			}
+		})
+	}
+}
+
+func TestWhen(t *testing.T) {
+	tests := []struct {
+		name    string
+		points  []Point
+		quota   float64
+		reached bool
+		when    time.Time
+	}{
+		{
+			name:    "growing",
+			points:  daily(100, 200, 300, 400, 500),
+			quota:   1000,
+			reached: true,
+			when:    origin.Add(9 * day),
+		},
+		{
+			// The quota is reached before the latest reading.
+			name:    "quota already exceeded",
+			points:  daily(100, 200, 300, 400, 500),
+			quota:   150,
+			reached: true,
+			when:    origin.Add(day / 2),
+		},
+		{
+			name:    "negative slope",
+			points:  daily(500, 400, 300, 200, 100),
+			quota:   1000,
+			reached: false,
+		},
+		{
+			name:    "flat",
+			points:  daily(100, 100, 100, 100, 100),
+			quota:   1000,
+			reached: false,
+		},
+		{
+			name: "barely growing",
+			points: []Point{
+				{Time: origin, Value: 0},
+				{Time: origin.Add(day), Value: 1e-12},
+				{Time: origin.Add(2 * day), Value: 2e-12},
+				{Time: origin.Add(3 * day), Value: 3e-12},
+				{Time: origin.Add(4 * day), Value: 4e-12},
+			},
+			quota:   1e15,
+			reached: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trend, err := Fit(tc.points)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			when, reached := trend.When(tc.quota)
+			if reached != tc.reached {
+				t.Fatalf("expected reached to be %t, got %t", tc.reached, reached)
+			}
+			if !reached {
+				if !when.IsZero() {
+					t.Errorf("expected the zero time, got %s", when)
+				}
+				return
+			}
+			if d := when.Sub(tc.when); d < -time.Second || d > time.Second {
+				t.Errorf("expected %s, got %s", tc.when, when)
+			}
+		})
+	}
+}
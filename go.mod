@@ -13,12 +13,14 @@ require (
 	github.com/cyverse-de/go-mod/subjects v0.1.4
 	github.com/cyverse-de/messaging/v9 v9.1.5
 	github.com/cyverse-de/p/go/qms v0.2.1
+	github.com/cyverse-de/p/go/svcerror v0.0.8
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/labstack/echo/v4 v4.11.4
 	github.com/labstack/gommon v0.4.2
 	github.com/lib/pq v1.10.9
 	github.com/nats-io/nats.go v1.33.1
 	github.com/pkg/errors v0.9.1
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/samber/lo v1.39.0
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/viper v1.18.2
@@ -27,6 +29,7 @@ require (
 	github.com/uptrace/opentelemetry-go-extra/otelsqlx v0.2.3
 	go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho v0.49.0
 	go.opentelemetry.io/otel v1.24.0
+	golang.org/x/sync v0.5.0
 	google.golang.org/protobuf v1.36.6
 )
 
@@ -37,7 +40,6 @@ require (
 	github.com/cyverse-de/p/go/containers v0.0.2 // indirect
 	github.com/cyverse-de/p/go/header v0.0.4 // indirect
 	github.com/cyverse-de/p/go/monitoring v0.0.5 // indirect
-	github.com/cyverse-de/p/go/svcerror v0.0.8 // indirect
 	github.com/cyverse-de/p/go/user v0.0.11 // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/go-logr/logr v1.4.1 // indirect
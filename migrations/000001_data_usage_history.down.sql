@@ -0,0 +1 @@
+DROP TABLE IF EXISTS {{.Schema}}.data_usage_history;
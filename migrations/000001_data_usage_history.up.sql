@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS {{.Schema}}.data_usage_history (
+  id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+  user_id uuid NOT NULL REFERENCES {{.Schema}}.users(id) ON DELETE CASCADE,
+  total bigint NOT NULL,
+  home_bytes bigint NOT NULL DEFAULT 0,
+  trash_bytes bigint NOT NULL DEFAULT 0,
+  source text NOT NULL,
+  recorded_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS data_usage_history_user_id_recorded_at_idx
+    ON {{.Schema}}.data_usage_history(user_id, recorded_at);
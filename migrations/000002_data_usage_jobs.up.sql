@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS {{.Schema}}.data_usage_jobs (
+  id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+  created_at timestamp with time zone NOT NULL DEFAULT now(),
+  batches_total integer NOT NULL DEFAULT 0,
+  batches_published integer NOT NULL DEFAULT 0,
+  batches_completed integer NOT NULL DEFAULT 0,
+  batches_failed integer NOT NULL DEFAULT 0,
+  publishing_done boolean NOT NULL DEFAULT false
+);
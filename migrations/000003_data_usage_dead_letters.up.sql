@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS {{.Schema}}.data_usage_dead_letters (
+  id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+  queue text NOT NULL,
+  routing_key text NOT NULL,
+  body bytea NOT NULL,
+  reason text NOT NULL,
+  failed_at timestamp with time zone NOT NULL DEFAULT now(),
+  replayed_at timestamp with time zone
+);
@@ -0,0 +1,5 @@
+ALTER TABLE {{.Schema}}.data_usage_jobs
+  DROP COLUMN IF EXISTS users_written,
+  DROP COLUMN IF EXISTS users_skipped;
+
+DROP TABLE IF EXISTS {{.Schema}}.data_usage_qms_pushes;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS {{.Schema}}.data_usage_qms_pushes (
+  user_id uuid NOT NULL PRIMARY KEY REFERENCES {{.Schema}}.users(id) ON DELETE CASCADE,
+  total bigint NOT NULL,
+  pushed_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+ALTER TABLE {{.Schema}}.data_usage_jobs
+  ADD COLUMN IF NOT EXISTS users_written integer NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS users_skipped integer NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE {{.Schema}}.data_usage_jobs ADD COLUMN IF NOT EXISTS kind text NOT NULL DEFAULT 'full';
@@ -0,0 +1 @@
+ALTER TABLE {{.Schema}}.data_usage_qms_pushes DROP COLUMN IF EXISTS object_count;
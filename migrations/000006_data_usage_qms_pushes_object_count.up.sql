@@ -0,0 +1 @@
+ALTER TABLE {{.Schema}}.data_usage_qms_pushes ADD COLUMN IF NOT EXISTS object_count bigint;
@@ -0,0 +1 @@
+ALTER TABLE {{.Schema}}.data_usage_history DROP COLUMN IF EXISTS breakdown;
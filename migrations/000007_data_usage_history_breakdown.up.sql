@@ -0,0 +1 @@
+ALTER TABLE {{.Schema}}.data_usage_history ADD COLUMN IF NOT EXISTS breakdown jsonb;
@@ -0,0 +1 @@
+ALTER TABLE {{.Schema}}.data_usage_jobs DROP COLUMN IF EXISTS heartbeat_at;
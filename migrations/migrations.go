@@ -0,0 +1,12 @@
+// Package migrations holds the versioned migrations for the tables this
+// service keeps in the DE database. Each version has an up and a down file,
+// named <version>_<description>.<up|down>.sql. The files are templates, with
+// {{.Schema}} standing in for the configured db.schema.
+package migrations
+
+import "embed"
+
+// FS contains the migration files.
+//
+//go:embed *.sql
+var FS embed.FS
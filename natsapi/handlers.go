@@ -0,0 +1,284 @@
+package natsapi
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/data-usage-api/db"
+	"github.com/cyverse-de/data-usage-api/logging"
+	"github.com/cyverse-de/data-usage-api/natsconn"
+	"github.com/cyverse-de/data-usage-api/transport"
+	"github.com/cyverse-de/data-usage-api/util"
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "natsapi"})
+
+// The subjects, relative to the connector's base subject, that the handlers
+// are registered on.
+const (
+	CurrentUsageSubject = "user.usages.get"
+	UpdateUsageSubject  = "user.usages.update"
+	OveragesSubject     = "user.overages.get"
+	CheckOverageSubject = "user.overages.check"
+)
+
+// Handlers answers NATS requests that mirror the HTTP API.
+type Handlers struct {
+	dedb          *sqlx.DB
+	icat          *sqlx.DB
+	transport     transport.Transport
+	nc            *natsconn.Connector
+	configuration *config.Config
+	updates       chan func()
+}
+
+func New(dedb, icat *sqlx.DB, t transport.Transport, nc *natsconn.Connector, configuration *config.Config) *Handlers {
+	return &Handlers{
+		dedb:          dedb,
+		icat:          icat,
+		transport:     t,
+		nc:            nc,
+		configuration: configuration,
+		updates:       make(chan func(), configuration.UpdateQueueSize),
+	}
+}
+
+// Register starts the update workers and subscribes all of the handlers on
+// the connector.
+func (h *Handlers) Register() error {
+	for i := 0; i < h.configuration.UpdateWorkers; i++ {
+		go h.updateWorker()
+	}
+
+	handlers := map[string]interface{}{
+		CurrentUsageSubject: h.CurrentUsageHandler,
+		UpdateUsageSubject:  h.UpdateUsageHandler,
+		OveragesSubject:     h.OveragesHandler,
+		CheckOverageSubject: h.CheckOverageHandler,
+	}
+
+	for name, handler := range handlers {
+		subject, queue, err := h.nc.Subscribe(name, handler)
+		if err != nil {
+			return errors.Wrapf(err, "failed subscribing to %s", name)
+		}
+		log.Infof("subscribed to %s on queue %s via NATS", subject, queue)
+	}
+
+	return nil
+}
+
+// serviceError converts an error into a service error for a response,
+// reporting QMS outages as such.
+func serviceError(ctx context.Context, err error) *svcerror.ServiceError {
+	if errors.Is(err, natsconn.ErrQMSUnavailable) {
+		return gotelnats.InitServiceError(ctx, err, &gotelnats.ErrorOptions{
+			ErrorCode:  svcerror.ErrorCode_UNSPECIFIED,
+			StatusCode: http.StatusServiceUnavailable,
+		})
+	}
+	return gotelnats.InitServiceError(ctx, err, nil)
+}
+
+func missingUsername(ctx context.Context) *svcerror.ServiceError {
+	return gotelnats.InitServiceError(ctx, errors.New("No username provided"), &gotelnats.ErrorOptions{
+		ErrorCode:  svcerror.ErrorCode_PARAMETER_MISSING,
+		StatusCode: http.StatusBadRequest,
+	})
+}
+
+func (h *Handlers) respond(ctx context.Context, reply string, resp gotelnats.DEResponse) {
+	if err := gotelnats.PublishResponse(ctx, h.nc.Conn, reply, resp); err != nil {
+		log.Error(errors.Wrap(err, "failed sending NATS response"))
+	}
+}
+
+// updateWorker runs the usage updates handed to it through the queue.
+// Updates run here rather than in the subscription callbacks, which NATS calls
+// one at a time, so a slow ICAT doesn't hold up every other request.
+func (h *Handlers) updateWorker() {
+	for update := range h.updates {
+		update()
+	}
+}
+
+func (h *Handlers) enqueueUserUpdate(ctx context.Context, user string) {
+	log.Tracef("Enqueuing update message for %s", user)
+	err := h.transport.EnqueueUserUpdate(ctx, user)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed enqueuing update message"))
+	}
+}
+
+func usageMessage(u *natsconn.UserDataUsage) *qms.Usage {
+	return &qms.Usage{
+		Uuid:  u.ID,
+		Usage: float64(u.Total),
+		ResourceType: &qms.ResourceType{
+			Name: "data.size",
+			Unit: "bytes",
+		},
+		CreatedAt:      timestamppb.New(u.Time),
+		LastModifiedAt: timestamppb.New(u.LastModified),
+	}
+}
+
+// CurrentUsageHandler returns the user's current data usage as recorded in
+// QMS, enqueueing an update if it's missing or stale.
+func (h *Handlers) CurrentUsageHandler(subject, reply string, req *qms.GetUsages) {
+	ctx, span := gotelnats.StartSpan(&gotelnats.PBTextMapCarrier{Header: req.Header}, subject, gotelnats.Process)
+	defer span.End()
+
+	resp := pbinit.NewUsageResponse()
+	defer h.respond(ctx, reply, resp)
+
+	if req.Username == "" {
+		resp.Error = missingUsername(ctx)
+		return
+	}
+	user := util.FixUsername(req.Username, h.configuration)
+
+	usage, err := h.nc.UserCurrentDataUsage(ctx, h.configuration, user)
+	if err == sql.ErrNoRows {
+		h.enqueueUserUpdate(ctx, user)
+		resp.Error = gotelnats.InitServiceError(ctx, errors.New("No data usage information found for user"), &gotelnats.ErrorOptions{
+			ErrorCode:  svcerror.ErrorCode_NOT_FOUND,
+			StatusCode: http.StatusNotFound,
+		})
+		return
+	} else if err != nil {
+		e := errors.Wrap(err, "Failed fetching current usage")
+		log.Error(e)
+		resp.Error = serviceError(ctx, e)
+		return
+	}
+
+	if usage.Time.Add(*h.configuration.RefreshInterval).Before(time.Now()) {
+		h.enqueueUserUpdate(ctx, user)
+	}
+
+	resp.Usage = usageMessage(usage)
+}
+
+// UpdateUsageHandler recalculates the user's usage and pushes it to QMS on
+// one of the update workers, replying once it's done. If every worker is busy
+// and the queue is full, the update is enqueued through the transport instead
+// and the caller is told it's unavailable.
+func (h *Handlers) UpdateUsageHandler(subject, reply string, req *qms.RequestByUsername) {
+	ctx, span := gotelnats.StartSpan(&gotelnats.PBTextMapCarrier{Header: req.Header}, subject, gotelnats.Process)
+
+	if req.Username == "" {
+		defer span.End()
+		resp := pbinit.NewUsageResponse()
+		resp.Error = missingUsername(ctx)
+		h.respond(ctx, reply, resp)
+		return
+	}
+	user := util.FixUsername(req.Username, h.configuration)
+
+	update := func() {
+		defer span.End()
+		h.updateUsage(ctx, reply, user)
+	}
+
+	select {
+	case h.updates <- update:
+	default:
+		defer span.End()
+		h.enqueueUserUpdate(ctx, user)
+		resp := pbinit.NewUsageResponse()
+		resp.Error = gotelnats.InitServiceError(ctx, errors.New("Too many usage updates in progress, the update has been queued"), &gotelnats.ErrorOptions{
+			ErrorCode:  svcerror.ErrorCode_UNSPECIFIED,
+			StatusCode: http.StatusServiceUnavailable,
+		})
+		h.respond(ctx, reply, resp)
+	}
+}
+
+func (h *Handlers) updateUsage(ctx context.Context, reply, user string) {
+	resp := pbinit.NewUsageResponse()
+	defer h.respond(ctx, reply, resp)
+
+	updateCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	dbs := db.NewBoth(h.dedb, h.icat, h.configuration, h.nc)
+	usage, err := dbs.UpdateUserDataUsage(updateCtx, user, db.UsageSourceManual)
+	if err != nil {
+		e := errors.Wrap(err, "Failed updating usage information")
+		log.Error(e)
+		resp.Error = serviceError(ctx, e)
+		return
+	}
+
+	resp.Usage = usageMessage(usage)
+}
+
+// OveragesHandler returns every resource the user is over quota on.
+func (h *Handlers) OveragesHandler(subject, reply string, req *qms.AllUserOveragesRequest) {
+	ctx, span := gotelnats.StartSpan(&gotelnats.PBTextMapCarrier{Header: req.Header}, subject, gotelnats.Process)
+	defer span.End()
+
+	resp := pbinit.NewOverageList()
+	defer h.respond(ctx, reply, resp)
+
+	if req.Username == "" {
+		resp.Error = missingUsername(ctx)
+		return
+	}
+
+	overages, err := h.nc.AllResourceOveragesForUser(ctx, h.configuration, req.Username)
+	if err != nil {
+		e := errors.Wrap(err, "failed getting all resource overages")
+		log.Error(e)
+		resp.Error = serviceError(ctx, e)
+		return
+	}
+
+	resp.Overages = overages.Overages
+}
+
+// CheckOverageHandler reports whether the user is over quota on a resource,
+// which defaults to data.size.
+func (h *Handlers) CheckOverageHandler(subject, reply string, req *qms.IsOverageRequest) {
+	ctx, span := gotelnats.StartSpan(&gotelnats.PBTextMapCarrier{Header: req.Header}, subject, gotelnats.Process)
+	defer span.End()
+
+	resp := pbinit.NewIsOverage()
+	defer h.respond(ctx, reply, resp)
+
+	if req.Username == "" {
+		resp.Error = missingUsername(ctx)
+		return
+	}
+
+	resourceName := req.ResourceName
+	if resourceName == "" {
+		resourceName = "data.size"
+	}
+
+	overages, err := h.nc.AllResourceOveragesForUser(ctx, h.configuration, req.Username)
+	if err != nil {
+		e := errors.Wrap(err, "failed getting all resource overages")
+		log.Error(e)
+		resp.Error = serviceError(ctx, e)
+		return
+	}
+
+	for _, overage := range overages.Overages {
+		if overage.ResourceName == resourceName {
+			resp.IsOverage = true
+		}
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cyverse-de/data-usage-api/config"
@@ -23,6 +26,8 @@ import (
 type Connector struct {
 	baseSubject string
 	baseQueue   string
+	retry       RetrySettings
+	breaker     *circuitBreaker
 	Conn        *nats.EncodedConn
 }
 
@@ -37,6 +42,7 @@ type ConnectorSettings struct {
 	MaxReconnects int
 	ReconnectWait int
 	EnvPrefix     string
+	Retry         RetrySettings
 }
 
 func (nc *Connector) buildSubject(base string, fields ...string) string {
@@ -102,6 +108,8 @@ func NewConnector(cs *ConnectorSettings) (*Connector, error) {
 	connector := &Connector{
 		baseSubject: cs.BaseSubject,
 		baseQueue:   cs.BaseQueue,
+		retry:       cs.Retry,
+		breaker:     newCircuitBreaker(cs.Retry.BreakerThreshold, cs.Retry.BreakerCooldown),
 		Conn:        ec,
 	}
 
@@ -126,7 +134,7 @@ func (nc *Connector) UserCurrentDataUsage(ctx context.Context, config *config.Co
 
 	resp := pbinit.NewUsageList()
 
-	if err = gotelnats.Request(ctx, nc.Conn, subjects.QMSGetUserUsages, req, resp); err != nil {
+	if err = request(ctx, nc, subjects.QMSGetUserUsages, req, resp); err != nil {
 		return nil, err
 	}
 
@@ -151,6 +159,96 @@ func (nc *Connector) UserCurrentDataUsage(ctx context.Context, config *config.Co
 	return retval, nil
 }
 
+// userSubscription returns the user's current QMS subscription. Returns
+// sql.ErrNoRows if the user has no subscription.
+func (nc *Connector) userSubscription(ctx context.Context, config *config.Config, username string) (*qms.Subscription, error) {
+	var err error
+
+	req := &qms.RequestByUsername{
+		Username: util.FixUsername(username, config),
+	}
+
+	_, span := pbinit.InitQMSRequestByUsername(req, subjects.QMSGetUserPlan)
+	defer span.End()
+
+	resp := pbinit.NewSubscriptionResponse()
+
+	if err = request(ctx, nc, subjects.QMSGetUserPlan, req, resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Subscription == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return resp.Subscription, nil
+}
+
+// UserDataQuota returns the user's data.size quota from their current QMS
+// subscription. Returns sql.ErrNoRows if the subscription has no data.size
+// quota.
+func (nc *Connector) UserDataQuota(ctx context.Context, config *config.Config, username string) (float64, error) {
+	subscription, err := nc.userSubscription(ctx, config, username)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, q := range subscription.Quotas {
+		if q.ResourceType != nil && q.ResourceType.Name == "data.size" {
+			return q.Quota, nil
+		}
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+// UserDataQuotaStatus looks up the user's data.size quota, usage and overage
+// state in QMS. A user without a recorded usage is treated as using nothing;
+// the returned bool reports whether a usage was found.
+func (nc *Connector) UserDataQuotaStatus(ctx context.Context, config *config.Config, username string) (*QuotaStatus, bool, error) {
+	user := util.FixUsername(username, config)
+
+	quota, err := nc.UserDataQuota(ctx, config, user)
+	if err != nil {
+		return nil, false, err
+	}
+
+	retval := &QuotaStatus{
+		Username:     user,
+		ResourceName: "data.size",
+		Unit:         "bytes",
+		Quota:        quota,
+	}
+
+	usageFound := true
+	usage, err := nc.UserCurrentDataUsage(ctx, config, user)
+	if err == sql.ErrNoRows {
+		usageFound = false
+	} else if err != nil {
+		return nil, false, err
+	} else {
+		retval.Usage = float64(usage.Total)
+		retval.LastModified = usage.LastModified
+	}
+
+	overages, err := nc.AllResourceOveragesForUser(ctx, config, user)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, overage := range overages.Overages {
+		if overage.ResourceName == "data.size" {
+			retval.HasOverage = true
+		}
+	}
+
+	retval.Remaining = math.Max(quota-retval.Usage, 0)
+	if quota > 0 {
+		retval.PercentUsed = retval.Usage / quota * 100
+	}
+
+	return retval, usageFound, nil
+}
+
 func (nc *Connector) AllResourceOveragesForUser(ctx context.Context, config *config.Config, username string) (*qms.OverageList, error) {
 	var err error
 
@@ -165,9 +263,9 @@ func (nc *Connector) AllResourceOveragesForUser(ctx context.Context, config *con
 
 	resp := pbinit.NewOverageList()
 
-	if err = gotelnats.Request(
+	if err = request(
 		ctx,
-		nc.Conn,
+		nc,
 		subject,
 		req,
 		resp,
@@ -178,7 +276,63 @@ func (nc *Connector) AllResourceOveragesForUser(ctx context.Context, config *con
 	return resp, nil
 }
 
+// ObjectCountResource and ObjectCountUnit identify the QMS resource type that
+// users' data object counts are pushed as.
+const (
+	ObjectCountResource = "data.objects"
+	ObjectCountUnit     = "objects"
+)
+
+// DetailedOveragesForUser returns every resource the user is over quota on,
+// along with the quota and usage values QMS reported. Overages don't include
+// units, so they're taken from the resource types of the quotas in the user's
+// subscription.
+func (nc *Connector) DetailedOveragesForUser(ctx context.Context, config *config.Config, username string) ([]ResourceOverage, error) {
+	overages, err := nc.AllResourceOveragesForUser(ctx, config, username)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]ResourceOverage, 0, len(overages.Overages))
+	if len(overages.Overages) == 0 {
+		return retval, nil
+	}
+
+	units := make(map[string]string)
+	subscription, err := nc.userSubscription(ctx, config, username)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if subscription != nil {
+		for _, q := range subscription.Quotas {
+			if q.ResourceType != nil {
+				units[q.ResourceType.Name] = q.ResourceType.Unit
+			}
+		}
+	}
+
+	for _, overage := range overages.Overages {
+		retval = append(retval, ResourceOverage{
+			ResourceName: overage.ResourceName,
+			Quota:        overage.Quota,
+			Usage:        overage.Usage,
+			Unit:         units[overage.ResourceName],
+		})
+	}
+
+	return retval, nil
+}
+
 func (nc *Connector) UpdateUsageForUser(ctx context.Context, config *config.Config, username string, usageValue float64) (*UserDataUsage, error) {
+	return nc.updateUsage(ctx, config, username, &qms.ResourceType{Name: "data.size", Unit: "bytes"}, usageValue)
+}
+
+// UpdateObjectCountForUser sets the user's data object count in QMS.
+func (nc *Connector) UpdateObjectCountForUser(ctx context.Context, config *config.Config, username string, count float64) (*UserDataUsage, error) {
+	return nc.updateUsage(ctx, config, username, &qms.ResourceType{Name: ObjectCountResource, Unit: ObjectCountUnit}, count)
+}
+
+func (nc *Connector) updateUsage(ctx context.Context, config *config.Config, username string, resourceType *qms.ResourceType, usageValue float64) (*UserDataUsage, error) {
 	var err error
 
 	user := util.FixUsername(username, config)
@@ -189,10 +343,7 @@ func (nc *Connector) UpdateUsageForUser(ctx context.Context, config *config.Conf
 		Operation: &qms.UpdateOperation{
 			Name: "SET",
 		},
-		ResourceType: &qms.ResourceType{
-			Name: "data.size",
-			Unit: "bytes",
-		},
+		ResourceType: resourceType,
 		User: &qms.QMSUser{
 			Username: user,
 		},
@@ -205,7 +356,7 @@ func (nc *Connector) UpdateUsageForUser(ctx context.Context, config *config.Conf
 
 	resp := pbinit.NewQMSAddUpdateResponse()
 
-	if err = gotelnats.Request(ctx, nc.Conn, subjects.QMSAddUserUpdate, req, resp); err != nil {
+	if err = request(ctx, nc, subjects.QMSAddUserUpdate, req, resp); err != nil {
 		return nil, err
 	}
 
@@ -221,21 +372,45 @@ func (nc *Connector) UpdateUsageForUser(ctx context.Context, config *config.Conf
 	return retval, nil
 }
 
-func (nc *Connector) AddUserUpdatesBatch(ctx context.Context, config *config.Config, usages map[string]float64) ([]*UserDataUsage, error) {
-	keys := lo.Keys(usages)
-	retval := make([]*UserDataUsage, 0)
-	errs := make([]error, 0)
-	for _, k := range keys {
-		u, err := nc.UpdateUsageForUser(ctx, config, k, usages[k])
-		if err != nil {
-			errs = append(errs, err)
-		}
-		retval = append(retval, u)
+// AddUserUpdatesBatch pushes the usages to QMS, sending up to
+// config.QMSBatchConcurrency updates at a time. It returns a result for every
+// user, in username order.
+func (nc *Connector) AddUserUpdatesBatch(ctx context.Context, config *config.Config, usages map[string]float64) []UserUpdateResult {
+	return nc.updatesBatch(ctx, config, usages, nc.UpdateUsageForUser)
+}
+
+// AddUserObjectCountsBatch is like AddUserUpdatesBatch, but pushes data object
+// counts.
+func (nc *Connector) AddUserObjectCountsBatch(ctx context.Context, config *config.Config, counts map[string]float64) []UserUpdateResult {
+	return nc.updatesBatch(ctx, config, counts, nc.UpdateObjectCountForUser)
+}
+
+type updateFunc func(context.Context, *config.Config, string, float64) (*UserDataUsage, error)
+
+func (nc *Connector) updatesBatch(ctx context.Context, config *config.Config, values map[string]float64, update updateFunc) []UserUpdateResult {
+	keys := lo.Keys(values)
+	sort.Strings(keys)
+
+	concurrency := config.QMSBatchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
 	}
-	// If we got errors, throw the first one. It's a little ugly but is the
-	// error that'd get thrown if we were doing it in the loop anyway.
-	if len(errs) > 0 {
-		return retval, errs[0]
+
+	retval := make([]UserUpdateResult, len(keys))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, k := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, k string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			u, err := update(ctx, config, k, values[k])
+			retval[i] = UserUpdateResult{Username: k, Usage: u, Err: err}
+		}(i, k)
 	}
-	return retval, nil
+	wg.Wait()
+
+	return retval
 }
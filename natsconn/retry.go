@@ -0,0 +1,235 @@
+package natsconn
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrQMSUnavailable is returned without contacting QMS while the circuit
+// breaker is open.
+var ErrQMSUnavailable = errors.New("QMS unavailable")
+
+// RetrySettings controls how QMS requests are retried.
+type RetrySettings struct {
+	// MaxRetries is how many times a request is retried after a transient
+	// failure. Zero disables retries.
+	MaxRetries int
+
+	// BaseDelay is the delay before the first retry. Each retry doubles it, up
+	// to MaxDelay, and a random jitter is applied.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// BreakerThreshold is the number of consecutive failed requests that opens
+	// the circuit breaker. Zero disables the breaker.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the breaker stays open before a single trial
+	// request is let through.
+	BreakerCooldown time.Duration
+}
+
+// isTransient returns whether a NATS error is worth retrying. Errors returned
+// by QMS itself mean it's up and answering, so they aren't retried.
+func isTransient(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrConnectionReconnecting) ||
+		errors.Is(err, nats.ErrDisconnected) ||
+		errors.Is(err, nats.ErrStaleConnection)
+}
+
+// backoff returns the delay before the given retry, with equal jitter applied.
+func (r *RetrySettings) backoff(retry int) time.Duration {
+	d := r.BaseDelay << retry
+	if d <= 0 || (r.MaxDelay > 0 && d > r.MaxDelay) {
+		d = r.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker fails requests fast after QMS has failed repeatedly.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrQMSUnavailable if the request shouldn't be attempted.
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrQMSUnavailable
+		}
+		// let a single trial request through
+		b.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		return ErrQMSUnavailable
+	}
+	return nil
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		log.Infof("QMS is responding again, closing the circuit breaker")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+// abandon notes that a request was given up on by its caller, which says
+// nothing about whether QMS is up. A trial request is let through again later.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+func (b *circuitBreaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			log.Errorf("QMS failed %d times in a row, opening the circuit breaker for %s", b.failures, b.cooldown)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// requestTimeout bounds a single attempt at a QMS request. Attempts are also
+// bounded by the caller's context, whichever ends first.
+const requestTimeout = 30 * time.Second
+
+// requestOnce is gotelnats.Request, but bounded by the context. A request that
+// runs out of its own time is reported as nats.ErrTimeout, while one that runs
+// out of the caller's time returns the context's error.
+func requestOnce[ReqType gotelnats.DERequest, RespType gotelnats.DEResponse](
+	ctx context.Context,
+	nc *Connector,
+	subject string,
+	req ReqType,
+	resp RespType,
+) error {
+	carrier := gotelnats.PBTextMapCarrier{
+		Header: req.GetHeader(),
+	}
+
+	_, span := gotelnats.InjectSpan(ctx, &carrier, subject, gotelnats.Send)
+	defer span.End()
+
+	attemptCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	err := nc.Conn.RequestWithContext(attemptCtx, subject, req, resp)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nats.ErrTimeout
+		}
+		return err
+	}
+
+	respErr := resp.GetError()
+	if respErr != nil && respErr.ErrorCode != svcerror.ErrorCode_UNSET {
+		if respErr.StatusCode != 0 {
+			return gotelnats.NewDEServiceError(respErr.ErrorCode, respErr.Message, respErr.StatusCode)
+		}
+		return gotelnats.NewDEServiceError(respErr.ErrorCode, respErr.Message)
+	}
+
+	return nil
+}
+
+// request sends a request to QMS, retrying transient failures with backoff and
+// failing fast while the circuit breaker is open. Only transient failures count
+// toward opening the breaker; the caller giving up doesn't.
+func request[ReqType gotelnats.DERequest, RespType gotelnats.DEResponse](
+	ctx context.Context,
+	nc *Connector,
+	subject string,
+	req ReqType,
+	resp RespType,
+) error {
+	if err := nc.breaker.allow(); err != nil {
+		return err
+	}
+
+	for retry := 0; ; retry++ {
+		err := requestOnce(ctx, nc, subject, req, resp)
+		if ctx.Err() != nil {
+			nc.breaker.abandon()
+			return err
+		}
+		if err == nil || !isTransient(err) {
+			nc.breaker.success()
+			return err
+		}
+
+		if retry >= nc.retry.MaxRetries {
+			nc.breaker.failure()
+			return err
+		}
+
+		delay := nc.retry.backoff(retry)
+		log.Infof("transient error sending %s, retrying in %s: %s", subject, delay, err)
+
+		select {
+		case <-ctx.Done():
+			nc.breaker.abandon()
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
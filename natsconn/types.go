@@ -2,6 +2,45 @@ package natsconn
 
 import "time"
 
+// TrashUsage breaks down a user's trash usage by the trash layout the data
+// was found in.
+type TrashUsage struct {
+	Home        int64 `db:"trash_home_bytes" json:"trash_home_bytes"`
+	DEIRODS     int64 `db:"trash_de_irods_bytes" json:"trash_de_irods_bytes"`
+	IPCServices int64 `db:"trash_ipcservices_bytes" json:"trash_ipcservices_bytes"`
+}
+
+// ReplicaUsage reports a user's usage under both replica accounting modes.
+// Logical usage counts one replica of each data object that isn't stale and
+// physical usage counts every replica. Stale replicas are also reported on
+// their own.
+type ReplicaUsage struct {
+	LogicalBytes  int64 `db:"logical_bytes" json:"logical_bytes"`
+	PhysicalBytes int64 `db:"physical_bytes" json:"physical_bytes"`
+	StaleBytes    int64 `db:"stale_bytes" json:"stale_bytes"`
+}
+
+// ObjectCounts reports how many data objects and collections make up a user's
+// usage. Data objects are counted once no matter how many replicas they have.
+// Collections are the ones directly holding at least one data object charged
+// to the user, so empty collections and collections holding only uncharged
+// replicas aren't counted.
+type ObjectCounts struct {
+	DataObjects int64 `db:"data_object_count" json:"data_object_count"`
+	Collections int64 `db:"collection_count" json:"collection_count"`
+}
+
+// UsageBreakdown splits a user's usage between their home collection, their
+// trash, and shared collections they own, if those are charged to them.
+type UsageBreakdown struct {
+	HomeBytes   int64 `db:"home_bytes" json:"home_bytes"`
+	TrashBytes  int64 `db:"trash_bytes" json:"trash_bytes"`
+	SharedBytes int64 `db:"shared_bytes" json:"shared_bytes"`
+	TrashUsage
+	ReplicaUsage
+	ObjectCounts
+}
+
 type UserDataUsage struct {
 	ID           string    `db:"id" json:"id"`
 	UserID       string    `db:"user_id" json:"user_id"`
@@ -9,4 +48,36 @@ type UserDataUsage struct {
 	Total        int64     `db:"total" json:"total"`
 	Time         time.Time `db:"time" json:"time"`
 	LastModified time.Time `db:"last_modified" json:"last_modified"`
+	*UsageBreakdown
+}
+
+// QuotaStatus combines a user's data.size quota and usage as recorded in QMS.
+type QuotaStatus struct {
+	Username     string    `json:"username"`
+	ResourceName string    `json:"resource_name"`
+	Unit         string    `json:"unit"`
+	Quota        float64   `json:"quota"`
+	Usage        float64   `json:"usage"`
+	Remaining    float64   `json:"remaining"`
+	PercentUsed  float64   `json:"percent_used"`
+	HasOverage   bool      `json:"has_overage"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ResourceOverage is a single resource type the user is over quota on.
+type ResourceOverage struct {
+	ResourceName string  `json:"resource_name"`
+	Quota        float64 `json:"quota"`
+	Usage        float64 `json:"usage"`
+	Unit         string  `json:"unit"`
+}
+
+// UserUpdateResult is the outcome of pushing a single user's usage to QMS as
+// part of a batch. Err is set if the update failed, otherwise Usage is, unless
+// Skipped is set because QMS already had the value.
+type UserUpdateResult struct {
+	Username string
+	Usage    *UserDataUsage
+	Skipped  bool
+	Err      error
 }
@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/data-usage-api/db"
+	"github.com/cyverse-de/data-usage-api/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "scheduler"})
+
+const otelName = "github.com/cyverse-de/data-usage-api/scheduler"
+
+// advisoryLockKey identifies the Postgres advisory lock that the replicas of
+// this service use to decide which of them runs a scheduled refresh. Full and
+// incremental refreshes share it, so they never start at the same time.
+const advisoryLockKey int64 = 0x64617461_75736167 // "datausag"
+
+// RunFunc starts a refresh and returns the ID of the job tracking it.
+type RunFunc func(context.Context) (string, error)
+
+// Scheduler periodically starts refreshes of a single kind. Every replica runs
+// a Scheduler, but only one of them starts a refresh for each scheduled run.
+type Scheduler struct {
+	dedb          *sqlx.DB
+	configuration *config.Config
+	kind          string
+	spec          string
+	schedule      cron.Schedule
+	run           RunFunc
+	cron          *cron.Cron
+}
+
+// New parses the schedule and returns a Scheduler that calls run when it
+// fires. The kind is the kind of job that run starts.
+func New(dedb *sqlx.DB, configuration *config.Config, kind, spec string, run RunFunc) (*Scheduler, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s refresh schedule %q", kind, spec)
+	}
+
+	return &Scheduler{
+		dedb:          dedb,
+		configuration: configuration,
+		kind:          kind,
+		spec:          spec,
+		schedule:      schedule,
+		run:           run,
+	}, nil
+}
+
+// Start begins running refreshes in the background.
+func (s *Scheduler) Start() {
+	s.cron = cron.New()
+	s.cron.Schedule(s.schedule, cron.FuncJob(s.tick))
+	s.cron.Start()
+	log.Infof("scheduled %s refreshes with schedule %q", s.kind, s.spec)
+}
+
+// Stop stops scheduling new refreshes.
+func (s *Scheduler) Stop() {
+	if s.cron != nil {
+		s.cron.Stop()
+	}
+}
+
+// minimumGap returns how recently a job may have started before a scheduled
+// run is skipped. Half of the scheduled period leaves plenty of room for clock
+// skew between replicas.
+func (s *Scheduler) minimumGap(now time.Time) time.Duration {
+	next := s.schedule.Next(now)
+	return s.schedule.Next(next).Sub(next) / 2
+}
+
+func (s *Scheduler) tick() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	ctx, span := otel.Tracer(otelName).Start(ctx, "scheduled refresh")
+	defer span.End()
+
+	if err := s.runIfLeader(ctx); err != nil {
+		log.Error(errors.Wrapf(err, "scheduled %s refresh failed", s.kind))
+	}
+}
+
+func (s *Scheduler) runIfLeader(ctx context.Context) error {
+	// Advisory locks belong to a session, so the lock and unlock need to use
+	// the same connection rather than whatever the pool hands out.
+	conn, err := s.dedb.Connx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed getting a DE database connection")
+	}
+	defer func() { _ = conn.Close() }()
+
+	var locked bool
+	if err = conn.GetContext(ctx, &locked, "SELECT pg_try_advisory_lock($1)", advisoryLockKey); err != nil {
+		return errors.Wrap(err, "failed trying the refresh lock")
+	}
+	if !locked {
+		log.Infof("another replica is running a scheduled refresh, skipping the %s refresh", s.kind)
+		return nil
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryLockKey); err != nil {
+			log.Error(errors.Wrap(err, "failed releasing the refresh lock"))
+		}
+	}()
+
+	// The lock only stops replicas from running at the same time. A replica
+	// whose timer fires a little late would otherwise start a second run once
+	// the first has released the lock.
+	latest, found, err := db.NewDE(conn, s.configuration).LatestUsageJobTime(ctx, s.kind)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if found && now.Sub(latest) < s.minimumGap(now) {
+		log.Infof("skipping scheduled %s refresh, a job started at %s", s.kind, latest)
+		return nil
+	}
+
+	jobID, err := s.run(ctx)
+	if jobID != "" {
+		log.Infof("started scheduled %s refresh job %s", s.kind, jobID)
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// amqpMessage adapts an AMQP delivery to a Message.
+type amqpMessage struct {
+	del amqp.Delivery
+}
+
+func (m *amqpMessage) Key() string {
+	return m.del.RoutingKey
+}
+
+func (m *amqpMessage) Body() []byte {
+	return m.del.Body
+}
+
+func (m *amqpMessage) Redelivered() bool {
+	return m.del.Redelivered
+}
+
+func (m *amqpMessage) Ack() error {
+	return m.del.Ack(false)
+}
+
+func (m *amqpMessage) Reject(requeue bool) error {
+	return m.del.Reject(requeue)
+}
+
+// Delay waits out the delay before requeueing the message, since RabbitMQ
+// can't requeue with a delay. The consumer is held up in the meantime, which
+// also keeps it from taking on more work that would fail the same way.
+func (m *amqpMessage) Delay(delay time.Duration) error {
+	time.Sleep(delay)
+	return m.del.Reject(true)
+}
+
+// AMQPTransport sends work messages through a RabbitMQ topic exchange.
+type AMQPTransport struct {
+	exchangeName    string
+	exchangeType    string
+	batchQueue      string
+	individualQueue string
+	userSuffix      string
+
+	publishClient          *messaging.Client
+	batchListenClient      *messaging.Client
+	individualListenClient *messaging.Client
+}
+
+// NewAMQP connects to the broker and sets up publishing. Nothing is consumed
+// until Listen is called.
+func NewAMQP(configuration *config.Config, batchQueue, individualQueue string) (*AMQPTransport, error) {
+	t := &AMQPTransport{
+		exchangeName:    configuration.AMQPExchangeName,
+		exchangeType:    configuration.AMQPExchangeType,
+		batchQueue:      batchQueue,
+		individualQueue: individualQueue,
+		userSuffix:      configuration.UserSuffix,
+	}
+
+	var err error
+
+	t.batchListenClient, err = messaging.NewClient(configuration.AMQPURI, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create the messaging listen client (batch)")
+	}
+
+	t.individualListenClient, err = messaging.NewClient(configuration.AMQPURI, true)
+	if err != nil {
+		t.Close()
+		return nil, errors.Wrap(err, "Unable to create the messaging listen client (individual)")
+	}
+
+	t.publishClient, err = messaging.NewClient(configuration.AMQPURI, true)
+	if err != nil {
+		t.Close()
+		return nil, errors.Wrap(err, "Unable to create the messaging publish client")
+	}
+
+	err = t.publishClient.SetupPublishing(t.exchangeName)
+	if err != nil {
+		t.Close()
+		return nil, errors.Wrap(err, "Unable to set up message publishing")
+	}
+
+	return t, nil
+}
+
+func (t *AMQPTransport) EnqueueUserUpdate(ctx context.Context, username string) error {
+	return t.Publish(ctx, UserKey(unqualified(username, t.userSuffix)), []byte{})
+}
+
+func (t *AMQPTransport) EnqueueBatch(ctx context.Context, start, end string, body []byte) error {
+	return t.Publish(ctx, BatchKey(unqualified(start, t.userSuffix), unqualified(end, t.userSuffix)), body)
+}
+
+func (t *AMQPTransport) Publish(ctx context.Context, key string, body []byte) error {
+	return t.publishClient.PublishContext(ctx, key, body)
+}
+
+// Listen consumes the batch and individual queues. The same handler serves
+// both, because the separate queues and routing keys keep them apart.
+func (t *AMQPTransport) Listen(handler Handler) error {
+	amqpHandler := func(ctx context.Context, del amqp.Delivery) {
+		handler(ctx, &amqpMessage{del: del})
+	}
+
+	go t.batchListenClient.Listen()
+	go t.individualListenClient.Listen()
+
+	// batch handler
+	// - listen for index.all (for convenience) and index.usage.data, and fetch all applicable users, batch them, and send out batch messages
+	// - listen for index.usage.data.batch.user.<start>.<end>, and update the usage information for users from <start> to <end>, inclusive
+	t.batchListenClient.AddConsumerMulti(
+		t.exchangeName,
+		t.exchangeType,
+		t.batchQueue,
+		[]string{IndexAllKey, FullRefreshKey, BatchUserPrefix + ".#"},
+		amqpHandler,
+		1)
+
+	// individual user handler
+	// - listen for index.usage.data.user.<username>, and update the usage information for just that user
+	t.individualListenClient.AddConsumerMulti(
+		t.exchangeName,
+		t.exchangeType,
+		t.individualQueue,
+		[]string{SingleUserPrefix + ".#"},
+		amqpHandler,
+		1)
+
+	return nil
+}
+
+func (t *AMQPTransport) Close() {
+	for _, client := range []*messaging.Client{t.batchListenClient, t.individualListenClient, t.publishClient} {
+		if client != nil {
+			client.Close()
+		}
+	}
+}
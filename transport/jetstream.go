@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/config"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+)
+
+// jetStreamAckWait is how long a consumer has to finish a message before it's
+// redelivered. It needs to outlast the batch handler's timeout.
+const jetStreamAckWait = 10 * time.Minute
+
+// jetStreamMessage adapts a JetStream message to a Message.
+type jetStreamMessage struct {
+	msg jetstream.Msg
+	key string
+}
+
+func (m *jetStreamMessage) Key() string {
+	return m.key
+}
+
+func (m *jetStreamMessage) Body() []byte {
+	return m.msg.Data()
+}
+
+func (m *jetStreamMessage) Redelivered() bool {
+	md, err := m.msg.Metadata()
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed reading message metadata"))
+		return false
+	}
+	return md.NumDelivered > 1
+}
+
+func (m *jetStreamMessage) Ack() error {
+	return m.msg.Ack()
+}
+
+func (m *jetStreamMessage) Reject(requeue bool) error {
+	if requeue {
+		return m.msg.Nak()
+	}
+	return m.msg.Term()
+}
+
+func (m *jetStreamMessage) Delay(delay time.Duration) error {
+	return m.msg.NakWithDelay(delay)
+}
+
+// JetStreamTransport sends work messages through a NATS JetStream work queue
+// stream. Keys are published as subjects below the configured subject prefix.
+type JetStreamTransport struct {
+	js                 jetstream.JetStream
+	stream             string
+	subjectPrefix      string
+	batchConsumer      string
+	individualConsumer string
+	userSuffix         string
+	maxAckPending      int
+
+	consumers []jetstream.ConsumeContext
+}
+
+// durableName turns a queue name into a valid consumer name, which can't
+// contain dots.
+func durableName(queue string) string {
+	return strings.ReplaceAll(queue, ".", "_")
+}
+
+// NewJetStream creates or updates the work queue stream. Nothing is consumed
+// until Listen is called.
+func NewJetStream(ctx context.Context, nc *nats.Conn, configuration *config.Config, batchQueue, individualQueue string) (*JetStreamTransport, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create the JetStream context")
+	}
+
+	t := &JetStreamTransport{
+		js:                 js,
+		stream:             configuration.JetStreamStream,
+		subjectPrefix:      configuration.JetStreamSubjectPrefix,
+		batchConsumer:      durableName(batchQueue),
+		individualConsumer: durableName(individualQueue),
+		userSuffix:         configuration.UserSuffix,
+		maxAckPending:      configuration.JetStreamMaxAckPending,
+	}
+
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      t.stream,
+		Subjects:  []string{t.subject(">")},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to set up the JetStream stream %s", t.stream)
+	}
+
+	return t, nil
+}
+
+func (t *JetStreamTransport) subject(key string) string {
+	return fmt.Sprintf("%s.%s", t.subjectPrefix, key)
+}
+
+func (t *JetStreamTransport) EnqueueUserUpdate(ctx context.Context, username string) error {
+	return t.Publish(ctx, UserKey(unqualified(username, t.userSuffix)), []byte{})
+}
+
+func (t *JetStreamTransport) EnqueueBatch(ctx context.Context, start, end string, body []byte) error {
+	return t.Publish(ctx, BatchKey(unqualified(start, t.userSuffix), unqualified(end, t.userSuffix)), body)
+}
+
+func (t *JetStreamTransport) Publish(ctx context.Context, key string, body []byte) error {
+	_, err := t.js.Publish(ctx, t.subject(key), body)
+	return err
+}
+
+// consume creates or updates a durable consumer for the subjects and starts
+// handing its messages to the handler one at a time. Like the AMQP prefetch of
+// 1, each replica pulls one message at a time, while maxAckPending caps how
+// many are in flight across all of the replicas sharing the consumer.
+func (t *JetStreamTransport) consume(name string, keys []string, handler Handler) error {
+	subjects := make([]string, 0, len(keys))
+	for _, key := range keys {
+		subjects = append(subjects, t.subject(key))
+	}
+
+	consumer, err := t.js.CreateOrUpdateConsumer(context.Background(), t.stream, jetstream.ConsumerConfig{
+		Durable:        name,
+		FilterSubjects: subjects,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        jetStreamAckWait,
+		MaxAckPending:  t.maxAckPending,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Unable to set up the JetStream consumer %s", name)
+	}
+
+	prefix := t.subject("")
+	cc, err := consumer.Consume(func(msg jetstream.Msg) {
+		handler(context.Background(), &jetStreamMessage{
+			msg: msg,
+			key: strings.TrimPrefix(msg.Subject(), prefix),
+		})
+	}, jetstream.PullMaxMessages(1), jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		log.Error(errors.Wrapf(err, "Error consuming from %s", name))
+	}))
+	if err != nil {
+		return errors.Wrapf(err, "Unable to consume from %s", name)
+	}
+
+	t.consumers = append(t.consumers, cc)
+	return nil
+}
+
+// Listen consumes the batch and individual work queues. A work queue stream
+// needs the consumers' subjects to be disjoint, which the keys already are.
+func (t *JetStreamTransport) Listen(handler Handler) error {
+	err := t.consume(t.batchConsumer, []string{IndexAllKey, FullRefreshKey, BatchUserPrefix + ".>"}, handler)
+	if err != nil {
+		return err
+	}
+
+	return t.consume(t.individualConsumer, []string{SingleUserPrefix + ".>"}, handler)
+}
+
+func (t *JetStreamTransport) Close() {
+	for _, cc := range t.consumers {
+		cc.Stop()
+	}
+}
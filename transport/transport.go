@@ -0,0 +1,82 @@
+// Package transport abstracts the message broker that usage recalculations
+// are triggered through.
+package transport
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/data-usage-api/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "transport"})
+
+// The keys work messages are published with. Batch start usernames can have
+// no dots, so the bounds can be split back out of the key.
+const (
+	IndexAllKey      = "index.all"
+	FullRefreshKey   = "index.usage.data"
+	SingleUserPrefix = "index.usage.data.user"
+	BatchUserPrefix  = "index.usage.data.batch.user"
+)
+
+// UserKey returns the key for a single-user update message.
+func UserKey(username string) string {
+	return fmt.Sprintf("%s.%s", SingleUserPrefix, username)
+}
+
+// BatchKey returns the key for a batch update message covering the users from
+// start to end, inclusive.
+func BatchKey(start, end string) string {
+	return fmt.Sprintf("%s.%s.%s", BatchUserPrefix, start, end)
+}
+
+// unqualified strips the user domain from a username, since keys only ever
+// contain the bare username.
+func unqualified(username, userSuffix string) string {
+	return strings.TrimSuffix(username, "@"+userSuffix)
+}
+
+// Message is a work message received from a transport.
+type Message interface {
+	// Key returns the key the message was published with.
+	Key() string
+	Body() []byte
+	// Redelivered reports whether an earlier delivery of the message failed.
+	Redelivered() bool
+	Ack() error
+	// Reject gives up on the message, handing it back to the transport to be
+	// delivered again if requeue is set.
+	Reject(requeue bool) error
+	// Delay hands the message back to the transport to be delivered again
+	// after roughly the given delay, for failures that are expected to clear
+	// up on their own.
+	Delay(delay time.Duration) error
+}
+
+// Handler processes a work message. It's responsible for rejecting the
+// message on failure, and the caller acknowledges it otherwise.
+type Handler func(ctx context.Context, msg Message)
+
+// Transport publishes and consumes the work messages that trigger usage
+// recalculations.
+type Transport interface {
+	// EnqueueUserUpdate requests a recalculation of a single user's usage.
+	EnqueueUserUpdate(ctx context.Context, username string) error
+
+	// EnqueueBatch requests a recalculation of the usage of the users from
+	// start to end, inclusive.
+	EnqueueBatch(ctx context.Context, start, end string, body []byte) error
+
+	// Publish sends a message with an arbitrary key, such as one being
+	// replayed from the dead letters.
+	Publish(ctx context.Context, key string, body []byte) error
+
+	// Listen starts consuming the batch and individual work queues.
+	Listen(handler Handler) error
+
+	Close()
+}